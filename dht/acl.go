@@ -0,0 +1,261 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclKey is where the ring keeps its access control list
+const aclKey = "__acl__"
+
+const (
+	// PermRead exported
+	PermRead = "r"
+	// PermWrite exported
+	PermWrite = "w"
+	// PermDelete exported
+	PermDelete = "d"
+)
+
+// Cred exported
+// a client's signature over one operation on one key and the value it
+// carries; an empty Client is the anonymous client. Owners refuse a Nonce
+// they have already seen on a write or delete
+type Cred struct {
+	Client string
+	Time int64
+	Nonce uint64
+	Sig []byte
+}
+
+// KeyArgs exported
+type KeyArgs struct {
+	Key string
+	Cred Cred
+}
+
+// ACLRule exported
+// grants Client ("*" for everyone, anonymous included) the permissions in
+// Perms, a subset of "rwd", on every key starting with Prefix
+type ACLRule struct {
+	Client, Prefix, Perms string
+}
+
+// ACL exported
+// Clients maps client names to ed25519 public keys; the admin signs the
+// document and a higher Serial replaces a lower one
+type ACL struct {
+	Serial uint64
+	Clients map[string][]byte
+	Rules []ACLRule
+	Sig []byte
+}
+
+type aclState struct {
+	admin ed25519.PublicKey
+	lock sync.Mutex
+	doc *ACL
+	// nonces of the writes and deletes accepted within authWindow
+	nonces map[string]time.Time
+}
+
+type clientKey struct {
+	name string
+	key ed25519.PrivateKey
+}
+
+func (a *ACL) message() []byte {
+	unsigned := *a
+	unsigned.Sig = nil
+	b, _ := json.Marshal(unsigned)
+	return b
+}
+
+// SignACL exported
+// signs acl with the admin key and encodes it for storage in the ring
+func SignACL(admin ed25519.PrivateKey, acl ACL) (string, error) {
+	acl.Sig = ed25519.Sign(admin, acl.message())
+	b, err := json.Marshal(acl)
+	return string(b), err
+}
+
+// credMessage is what a client signs: body is the value the request
+// carries, empty for reads and deletes, and only its digest is signed
+func credMessage(c Cred, op, key, body string) []byte {
+	digest := sha256.Sum256([]byte(body))
+	return []byte(c.Client + "|" + strconv.FormatInt(c.Time, 10) + "|" + strconv.FormatUint(c.Nonce, 10) +
+		"|" + op + "|" + key + "|" + hex.EncodeToString(digest[:]))
+}
+
+// credential signs op on key carrying body as n's client, or is anonymous
+// without one
+func (n *Node) credential(op, key, body string) Cred {
+	if n.client == nil {
+		return Cred{}
+	}
+	c := Cred {
+		Client: n.client.name,
+		Time: time.Now().UnixNano(),
+		Nonce: rand.Uint64(),
+	}
+	c.Sig = ed25519.Sign(n.client.key, credMessage(c, op, key, body))
+	return c
+}
+
+// parse decodes val and checks the admin's signature
+func (s *aclState) parse(val string) (*ACL, error) {
+	var doc ACL
+	err := json.Unmarshal([]byte(val), &doc)
+	if err != nil {
+		return nil, errors.New("acl: " + err.Error())
+	}
+	if !ed25519.Verify(s.admin, doc.message(), doc.Sig) {
+		return nil, errors.New("acl: not signed by admin")
+	}
+	return &doc, nil
+}
+
+// admit validates an ACL about to be stored and caches it; a put must
+// raise the serial, a migration may carry the current one
+func (s *aclState) admit(val string, migrating bool) error {
+	doc, err := s.parse(val)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.doc != nil && (doc.Serial < s.doc.Serial || doc.Serial == s.doc.Serial && !migrating) {
+		return errors.New("acl: serial " + strconv.FormatUint(doc.Serial, 10) + " is not newer")
+	}
+	s.doc = doc
+	return nil
+}
+
+func (s *aclState) current() *ACL {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.doc
+}
+
+// first records c's nonce and reports whether it is new; a credential is
+// good for authWindow either side of its time, so a nonce is forgotten once
+// twice that has passed
+func (s *aclState) first(c Cred) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for k, t := range s.nonces {
+		if now.Sub(t) > 2 * authWindow {
+			delete(s.nonces, k)
+		}
+	}
+	id := c.Client + "|" + strconv.FormatUint(c.Nonce, 10)
+	if _, ok := s.nonces[id]; ok {
+		return false
+	}
+	s.nonces[id] = now
+	return true
+}
+
+// allow checks that cred may perform op on key carrying body; everything is
+// allowed when n enforces no ACL, and nothing but the ACL itself before one
+// is published
+func (n *Node) allow(cred Cred, op, key, body string) error {
+	if n.acl == nil {
+		return nil
+	}
+	if key == aclKey {
+		if op == PermDelete {
+			return errors.New("acl: the access control list can't be deleted")
+		}
+		return nil
+	}
+	doc := n.acl.current()
+	if doc == nil {
+		return errors.New("acl: no access control list published")
+	}
+	client := cred.Client
+	if client != "" {
+		pub, ok := doc.Clients[client]
+		age := time.Since(time.Unix(0, cred.Time))
+		if !ok || len(pub) != ed25519.PublicKeySize || age > authWindow || age < -authWindow ||
+			!ed25519.Verify(pub, credMessage(cred, op, key, body), cred.Sig) {
+			n.auth.reject("acl")
+			return errors.New("acl: bad credential for " + client)
+		}
+		if op != PermRead && !n.acl.first(cred) {
+			n.auth.reject("acl")
+			return errors.New("acl: credential for " + client + " replayed")
+		}
+	}
+	for _, rule := range doc.Rules {
+		if (rule.Client == "*" || client != "" && rule.Client == client) &&
+			strings.HasPrefix(key, rule.Prefix) && strings.Contains(rule.Perms, op) {
+			return nil
+		}
+	}
+	n.auth.reject("acl")
+	if client == "" {
+		client = "anonymous"
+	}
+	return errors.New("acl: " + client + " may not " + op + " " + key)
+}
+
+// allowNode checks that auth was made by a ring member, which is how
+// migrations and watch hand-offs bypass client permissions; ACLs rely on the
+// ring secret for this
+func (n *Node) allowNode(auth Auth, fields ...string) error {
+	if n.acl == nil {
+		return nil
+	}
+	if n.secret == nil || auth.Signer == "" || !n.verify(auth, "", fields...) {
+		n.auth.reject("acl")
+		return errors.New("acl: " + fields[0] + " not signed by a ring member")
+	}
+	return nil
+}
+
+// refreshACLPeriodically keeps the cached ACL in line with the one stored
+// in the ring
+func (n *Node) refreshACLPeriodically() {
+	if n.acl == nil {
+		return
+	}
+	period := time.NewTicker(3 * time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		val, err := n.rpcGet(n.find(aclKey), aclKey)
+		if err != nil || val == "" {
+			continue
+		}
+		doc, err := n.acl.parse(val)
+		if err != nil {
+			Yellow.Println(TimeClock(), err)
+			continue
+		}
+		n.acl.lock.Lock()
+		if n.acl.doc == nil || doc.Serial > n.acl.doc.Serial {
+			n.acl.doc = doc
+			Magenta.Println(TimeClock(), "acl: serial", doc.Serial, "at", n.IP)
+		}
+		n.acl.lock.Unlock()
+	}
+}
+
+// PutACL exported
+// publishes acl to the ring, signed with the admin key
+func (c *Chord) PutACL(admin ed25519.PrivateKey, acl ACL) error {
+	val, err := SignACL(admin, acl)
+	if err != nil {
+		return err
+	}
+	return c.Node.rpcPut(c.Node.find(aclKey), PutArgs{Key: aclKey, Val: val})
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authWindow bounds how old or how far ahead a signature may be
+const authWindow = 30 * time.Second
+
+// Auth exported
+// a node's proof that it holds the ring's shared secret
+type Auth struct {
+	Signer string
+	Time int64
+	MAC []byte
+}
+
+// Address exported
+// a node address, signed by the node that vouches for it
+type Address struct {
+	Addr string
+	Auth Auth
+}
+
+type authStats struct {
+	lock sync.Mutex
+	rejected map[string]int
+}
+
+func (s *authStats) reject(what string) {
+	s.lock.Lock()
+	s.rejected[what]++
+	s.lock.Unlock()
+}
+
+func (s *authStats) snapshot() map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snapshot := make(map[string]int)
+	for k, v := range s.rejected {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+func mac(secret []byte, signer string, t int64, fields ...string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(signer + "|" + strconv.FormatInt(t, 10)))
+	for _, field := range fields {
+		h.Write([]byte("|" + field))
+	}
+	return h.Sum(nil)
+}
+
+// sign vouches for fields as n; without a secret it returns an empty Auth
+func (n *Node) sign(fields ...string) Auth {
+	if n.secret == nil {
+		return Auth{}
+	}
+	t := time.Now().UnixNano()
+	return Auth {
+		Signer: n.IP,
+		Time: t,
+		MAC: mac(n.secret, n.IP, t, fields...),
+	}
+}
+
+// verify checks that auth was made by a ring member over fields, and by
+// signer unless signer is empty; everything passes when n has no secret
+func (n *Node) verify(auth Auth, signer string, fields ...string) bool {
+	if n.secret == nil {
+		return true
+	}
+	if signer != "" && auth.Signer != signer {
+		return false
+	}
+	age := time.Since(time.Unix(0, auth.Time))
+	if age > authWindow || age < -authWindow {
+		return false
+	}
+	return hmac.Equal(auth.MAC, mac(n.secret, auth.Signer, auth.Time, fields...))
+}
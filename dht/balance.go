@@ -0,0 +1,444 @@
+package dht
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// balancePeriod is how often a node compares its load with others
+	balancePeriod = 5 * time.Second
+	// balanceSamples is how many random nodes it compares with
+	balanceSamples = 3
+	// balanceRatio is how much heavier than the lightest sample a node must
+	// be to shed load, and balanceMinLoad the least load worth shedding
+	balanceRatio = 2
+	balanceMinLoad = 32
+	// balanceCooldown keeps the nodes of a move out of the next one for a
+	// while, so that loads settle before they are compared again
+	balanceCooldown = 30 * time.Second
+	// positionTTL is how long the ID a node moved to is trusted when
+	// balancing lets IDs change
+	positionTTL = 2 * time.Second
+	// loadBytes is how many bytes stored weigh as much as one key, or as one
+	// request per second
+	loadBytes = 1024
+)
+
+// LoadStats exported
+type LoadStats struct {
+	Addr, ID string
+	Keys, Bytes int
+	Rate float64
+}
+
+// Load exported
+// weighs keys, bytes and requests into one figure
+func (s LoadStats) Load() float64 {
+	return float64(s.Keys) + float64(s.Bytes) / loadBytes + s.Rate
+}
+
+// Position exported
+type Position struct {
+	Addr, ID string
+	Auth Auth
+}
+
+// MoveArgs exported
+// asks a light node to leave and rejoin at ID, through Via, the heavy node
+// whose keys up to ID it takes over
+type MoveArgs struct {
+	ID, Via string
+	Load float64
+	Auth Auth
+}
+
+// LeaveArgs exported
+// tells the neighbours of Addr that it leaves from between them
+type LeaveArgs struct {
+	Addr, Predecessor, Successor string
+	Auth Auth
+}
+
+// balancer is the state of the load balancing of a node; IDs may only
+// change when every node of the ring balances
+type balancer struct {
+	lock sync.Mutex
+	last time.Time
+	busy bool
+	moves int
+}
+
+// claim reserves n for one move unless it took part in one lately
+func (b *balancer) claim() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.busy || time.Since(b.last) < balanceCooldown {
+		return false
+	}
+	b.busy = true
+	return true
+}
+
+func (b *balancer) release(moved bool) {
+	b.lock.Lock()
+	b.busy = false
+	b.last = time.Now()
+	if moved {
+		b.moves++
+	}
+	b.lock.Unlock()
+}
+
+func (h *heatTable) rate(key string) float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.rates[key]
+}
+
+func (c *identityCache) forget(addr string) {
+	c.lock.Lock()
+	delete(c.ids, addr)
+	c.lock.Unlock()
+}
+
+func (n *Node) load() LoadStats {
+	stats := LoadStats{Addr: n.IP, ID: n.id.Text(16)}
+	n.dataLock.Lock()
+	for k, v := range n.data {
+		stats.Keys++
+		stats.Bytes += len(k) + len(v)
+	}
+	n.dataLock.Unlock()
+	for _, hot := range n.heat.snapshot() {
+		stats.Rate += hot.Rate
+	}
+	return stats
+}
+
+// Load exported
+func (n *Node) Load(none bool, reply *LoadStats) error {
+	*reply = n.load()
+	return nil
+}
+
+func (n *Node) rpcLoad(addr string) (LoadStats, error) {
+	var reply LoadStats
+	client := n.dial(addr)
+	if client == nil {
+		return reply, errors.New("load: client offline")
+	}
+	defer client.Close()
+	err := client.Call("Node.Load", true, &reply)
+	return reply, err
+}
+
+// Position exported
+// the ring position of n, which balancing may have moved away from the
+// hash of its address
+func (n *Node) Position(none bool, reply *Position) error {
+	id := n.id.Text(16)
+	*reply = Position{Addr: n.IP, ID: id, Auth: n.sign("position", n.IP, id)}
+	return nil
+}
+
+// position fetches the ID of addr, caching it briefly since it changes
+// when addr moves
+func (n *Node) position(addr string) (*big.Int, error) {
+	if addr == n.IP {
+		return n.id, nil
+	}
+	if addr == "" {
+		return nil, errors.New("position: lack valid address")
+	}
+	n.ids.lock.Lock()
+	v, ok := n.ids.ids[addr]
+	n.ids.lock.Unlock()
+	if ok && time.Since(v.at) < positionTTL {
+		return v.id, nil
+	}
+	client := n.dial(addr)
+	if client == nil {
+		return nil, errors.New("position: client offline")
+	}
+	defer client.Close()
+	var reply Position
+	err := client.Call("Node.Position", true, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Addr != addr || !n.verify(reply.Auth, addr, "position", reply.Addr, reply.ID) {
+		return nil, errors.New("position: not signed by " + addr)
+	}
+	id, ok := new(big.Int).SetString(reply.ID, 16)
+	if !ok {
+		return nil, errors.New("position: bad ID from " + addr)
+	}
+	n.ids.lock.Lock()
+	n.ids.ids[addr] = verifiedID{id: id, at: time.Now()}
+	n.ids.lock.Unlock()
+	return id, nil
+}
+
+// split finds the ID that cuts the load of the keys n owns in half, so
+// that a node moving there takes over the lower half
+func (n *Node) split() (*big.Int, bool) {
+	type weighed struct {
+		id, offset *big.Int
+		load float64
+	}
+	if n.predecessor == "" {
+		return nil, false
+	}
+	var keys []weighed
+	total := 0.0
+	start := n.idOf(n.predecessor)
+	n.dataLock.Lock()
+	for k, v := range n.data {
+		id := hashString(k)
+		if !between(start, id, n.id, true) {
+			continue
+		}
+		load := 1 + float64(len(k) + len(v)) / loadBytes + n.heat.rate(k)
+		offset := new(big.Int).Sub(id, start)
+		keys = append(keys, weighed{id, offset.Mod(offset, hashMod), load})
+		total += load
+	}
+	n.dataLock.Unlock()
+	if len(keys) < 2 {
+		return nil, false
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].offset.Cmp(keys[j].offset) < 0
+	})
+	sum := 0.0
+	for _, k := range keys[:len(keys) - 1] {
+		sum += k.load
+		if sum >= total / 2 {
+			return k.id, k.id.Cmp(n.id) != 0
+		}
+	}
+	return nil, false
+}
+
+// Move exported
+// is how an overloaded node asks n to take over part of its keys; n agrees
+// only when it is still light next to it and didn't move lately, and then
+// moves in the background
+func (n *Node) Move(args MoveArgs, accepted *bool) error {
+	if !n.verify(args.Auth, args.Via, "move", args.ID, args.Via) {
+		n.auth.reject("move")
+		return errors.New("balance: move not signed by " + args.Via)
+	}
+	if n.balance == nil {
+		return errors.New("balance: not balancing")
+	}
+	id, ok := new(big.Int).SetString(args.ID, 16)
+	if !ok {
+		return errors.New("balance: bad ID")
+	}
+	if n.load().Load() * balanceRatio > args.Load {
+		return errors.New("balance: not light enough to move")
+	}
+	if !n.balance.claim() {
+		return errors.New("balance: moved lately")
+	}
+	*accepted = true
+	n.spawn(func() {
+		n.move(id, args.Via)
+	})
+	return nil
+}
+
+// move leaves the ring gracefully, handing everything to the successor
+// like a node that quits, and joins again at id before the node via finds
+// for it; n keeps routing with its old fingers meanwhile
+func (n *Node) move(id *big.Int, via string) {
+	from := n.id
+	successor := ""
+	for _, suc := range n.successor {
+		if suc != "" && suc != n.IP && n.ping(suc) {
+			successor = suc
+			break
+		}
+	}
+	target, err := n.rpcFindSuccessor(via, id)
+	if successor == "" || err != nil {
+		Cyan.Println(TimeClock(), "balance: move aborted, no successor for", id.Text(16), err)
+		n.balance.release(false)
+		return
+	}
+	n.moving = via
+	err = n.migrateWhenQuiting(successor)
+	if err != nil {
+		Cyan.Println(TimeClock(), "balance: move aborted,", err)
+		n.moving = ""
+		n.balance.release(false)
+		return
+	}
+	leave := LeaveArgs {
+		Addr: n.IP,
+		Predecessor: n.predecessor,
+		Successor: successor,
+		Auth: n.sign("leave", n.IP),
+	}
+	n.rpcLeave(successor, leave)
+	n.rpcLeave(n.predecessor, leave)
+	pred, err := n.rpcGetPredecessor(target)
+	if err != nil || pred == n.IP {
+		pred = ""
+	}
+	n.id = id
+	n.predecessor = pred
+	n.successor = [3]string{target}
+	n.cache.lock.Lock()
+	n.cache.ranges = make(map[string]*ownerRange)
+	n.cache.lock.Unlock()
+	err = n.rpcMigrateWhenJoining(target, n.IP)
+	n.moving = ""
+	if err != nil {
+		Red.Println(TimeClock(), "balance: rejoin before", target, "failed,", err)
+		n.balance.release(false)
+		return
+	}
+	n.balance.release(true)
+	n.neighbourChanged()
+	Magenta.Printf("%v Moved %v from %v to %v\n", TimeClock(), n.IP, from.Text(16), id.Text(16))
+}
+
+// Leave exported
+// unlinks a node leaving from between its neighbours
+func (n *Node) Leave(args LeaveArgs, reply *bool) error {
+	if !n.verify(args.Auth, args.Addr, "leave", args.Addr) {
+		n.auth.reject("leave")
+		return errors.New("leave: not signed by " + args.Addr)
+	}
+	n.ids.forget(args.Addr)
+	n.cache.forget(args.Addr)
+	if n.predecessor == args.Addr {
+		n.predecessor = args.Predecessor
+	}
+	var successors []string
+	for _, suc := range n.successor {
+		if suc != args.Addr {
+			successors = append(successors, suc)
+		}
+	}
+	if len(successors) < len(n.successor) {
+		successors = append([]string{args.Successor}, successors...)
+		copy(n.successor[:], successors)
+	}
+	for i := range n.finger {
+		if n.finger[i] == args.Addr {
+			n.finger[i] = ""
+		}
+	}
+	n.neighbourChanged()
+	*reply = true
+	return nil
+}
+
+func (n *Node) rpcLeave(addr string, args LeaveArgs) {
+	if addr == "" || addr == n.IP {
+		return
+	}
+	client := n.dial(addr)
+	if client == nil {
+		return
+	}
+	defer client.Close()
+	var reply bool
+	err := client.Call("Node.Leave", args, &reply)
+	if err != nil {
+		Cyan.Println(TimeClock(), "leave:", err, "at", addr)
+	}
+}
+
+// rebalance compares the load of n with a few random nodes and, when n is
+// much heavier than the lightest, asks it to move into the range of n
+func (n *Node) rebalance() {
+	own := n.load()
+	if own.Load() < balanceMinLoad {
+		return
+	}
+	var light LoadStats
+	for i := 0; i < balanceSamples; i++ {
+		addr, err := n.lookup(strconv.FormatInt(rand.Int63(), 10))
+		if err != nil || addr == "" || addr == n.IP {
+			continue
+		}
+		stats, err := n.rpcLoad(addr)
+		if err == nil && (light.Addr == "" || stats.Load() < light.Load()) {
+			light = stats
+		}
+	}
+	if light.Addr == "" || own.Load() < balanceRatio * light.Load() {
+		return
+	}
+	id, ok := n.split()
+	if !ok || !n.balance.claim() {
+		return
+	}
+	client := n.dial(light.Addr)
+	if client == nil {
+		n.balance.release(false)
+		return
+	}
+	defer client.Close()
+	args := MoveArgs {
+		ID: id.Text(16),
+		Via: n.IP,
+		Load: own.Load(),
+		Auth: n.sign("move", id.Text(16), n.IP),
+	}
+	var accepted bool
+	err := client.Call("Node.Move", args, &accepted)
+	if err != nil || !accepted {
+		Cyan.Println(TimeClock(), "balance:", light.Addr, "refused to move,", err)
+		n.balance.release(false)
+		return
+	}
+	Yellow.Printf("%v Balance: %v at load %.0f asks %v at load %.0f to move to %v\n", TimeClock(), n.IP, own.Load(), light.Addr, light.Load(), id.Text(16))
+	n.balance.release(true)
+}
+
+// rebalancePeriodically runs rebalance at jittered intervals so that nodes
+// don't all compare at once
+func (n *Node) rebalancePeriodically() {
+	for n.pause(balancePeriod + time.Duration(rand.Int63n(int64(balancePeriod)))) {
+		if n.balance != nil && n.moving == "" {
+			n.rebalance()
+		}
+	}
+}
+
+// Load exported
+func (c *Chord) Load() (LoadStats, error) {
+	if c.Node == nil {
+		return LoadStats{}, errors.New("Load: have not created or joined")
+	}
+	return c.Node.load(), nil
+}
+
+// BalanceCmd exported
+// balance on lets overloaded nodes move light ones into their range; it
+// must be on at every node since IDs then no longer follow addresses
+func (c *Chord) BalanceCmd(args ...string) error {
+	if len(args) < 1 || args[0] != "on" && args[0] != "off" {
+		return errors.New("Balance: expect on or off")
+	}
+	if c.Node != nil {
+		return errors.New("Balance: can't change once created or joined")
+	}
+	if args[0] == "on" && c.policy != nil {
+		return errors.New("Balance: node IDs are key based")
+	}
+	c.balance = args[0] == "on"
+	Magenta.Printf("%v Load balancing %v\n", TimeClock(), args[0])
+	return nil
+}
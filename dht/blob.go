@@ -0,0 +1,218 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// ChunkSize exported
+	// the most bytes of a blob stored under one key
+	ChunkSize = 256 * 1024
+	// chunkPrefix starts the key of every chunk, followed by its SHA-256
+	chunkPrefix = "chunk/"
+	// blobMagic starts the value of a key holding a blob manifest
+	blobMagic = "blob:"
+	// chunkTTL is how long a chunk outlives the last manifest renewing it
+	chunkTTL = 10 * time.Minute
+)
+
+var errBlobNotFound = errors.New("blob: match not found")
+
+// Manifest exported
+// lists the chunks of a blob in order
+type Manifest struct {
+	Size int64
+	Chunks []string
+}
+
+func parseManifest(val string) (*Manifest, bool) {
+	if !strings.HasPrefix(val, blobMagic) {
+		return nil, false
+	}
+	var m Manifest
+	err := json.Unmarshal([]byte(val[len(blobMagic):]), &m)
+	if err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+// putChunk stores one chunk at the owner of its hash; chunks are values
+// like any other, base64 encoded to survive the backup file
+func (n *Node) putChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	key := chunkPrefix + hash
+	_, err := n.storeItem(StoreArgs {
+		Op: StoreSet,
+		Item: Item{Key: key, Val: base64.StdEncoding.EncodeToString(data)},
+		TTL: chunkTTL,
+	})
+	return hash, err
+}
+
+func (n *Node) getChunk(hash string) ([]byte, error) {
+	key := chunkPrefix + hash
+	addr, err := n.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	val, err := n.rpcGet(addr, key)
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, errors.New("blob: chunk " + hash + " missing")
+	}
+	data, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, errors.New("blob: chunk " + hash + " corrupt")
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, errors.New("blob: chunk " + hash + " corrupt")
+	}
+	return data, nil
+}
+
+// putChunks stores everything r yields as chunks, in order
+func (n *Node) putChunks(r io.Reader) (*Manifest, error) {
+	m := &Manifest{Chunks: []string{}}
+	buf := make([]byte, ChunkSize)
+	for {
+		size, err := io.ReadFull(r, buf)
+		if size > 0 {
+			hash, err := n.putChunk(buf[:size])
+			if err != nil {
+				return nil, err
+			}
+			m.Chunks = append(m.Chunks, hash)
+			m.Size += int64(size)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// putBlob streams r into chunks and then publishes the manifest under key,
+// so readers never see a manifest whose chunks aren't stored yet
+func (n *Node) putBlob(key string, r io.Reader) (*Manifest, error) {
+	m, err := n.putChunks(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := n.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return m, n.rpcPut(addr, PutArgs{Key: key, Val: blobMagic + string(b)})
+}
+
+// manifest fetches the manifest of the blob under key
+func (n *Node) manifest(key string) (*Manifest, error) {
+	addr, err := n.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	val, err := n.rpcGet(addr, key)
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, errBlobNotFound
+	}
+	m, ok := parseManifest(val)
+	if !ok {
+		return nil, errors.New("blob: " + key + " is not a blob")
+	}
+	return m, nil
+}
+
+// readChunks streams the chunks of m into w one at a time
+func (n *Node) readChunks(m *Manifest, w io.Writer) error {
+	for _, hash := range m.Chunks {
+		data, err := n.getChunk(hash)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) getBlob(key string, w io.Writer) (*Manifest, error) {
+	m, err := n.manifest(key)
+	if err != nil {
+		return nil, err
+	}
+	return m, n.readChunks(m, w)
+}
+
+// renewChunksPeriodically extends the chunks of every manifest and
+// directory n owns; chunks that nothing renews any more expire, which is how
+// deleted and overwritten blobs and files are collected
+func (n *Node) renewChunksPeriodically() {
+	period := time.NewTicker(chunkTTL / 4)
+	defer period.Stop()
+	for n.tick(period) {
+		chunks := make(map[string]bool)
+		n.dataLock.Lock()
+		for _, val := range n.data {
+			for _, hash := range referencedChunks(val) {
+				chunks[hash] = true
+			}
+		}
+		n.dataLock.Unlock()
+		for hash := range chunks {
+			key := chunkPrefix + hash
+			client := n.dial(n.find(key))
+			if client == nil {
+				continue
+			}
+			var reply bool
+			client.Call("Node.Expire", ExpireArgs{Key: key, TTL: chunkTTL, Auth: n.sign("expire", key)}, &reply)
+			client.Close()
+		}
+	}
+}
+
+// PutBlob exported
+// stores everything r yields under key, ChunkSize bytes per ring key
+func (c *Chord) PutBlob(key string, r io.Reader) error {
+	m, err := c.Node.putBlob(key, r)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Put blob %v, %v bytes in %v chunks\n", TimeClock(), key, m.Size, len(m.Chunks))
+	return nil
+}
+
+// GetBlob exported
+// writes the blob stored under key to w
+func (c *Chord) GetBlob(key string, w io.Writer) error {
+	m, err := c.Node.getBlob(key, w)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Get blob %v, %v bytes in %v chunks\n", TimeClock(), key, m.Size, len(m.Chunks))
+	return nil
+}
@@ -0,0 +1,224 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BroadcastArgs exported
+// reaches every node between the receiver and Limit, exclusive; a Limit
+// equal to the receiver's own address covers the whole ring
+type BroadcastArgs struct {
+	ID, From, Msg, Limit string
+	Auth Auth
+}
+
+// Aggregate exported
+// what a broadcast collects from the nodes it reached: Nodes acked, Keys in
+// total, the least and most loaded node by key count, every member address,
+// and the nodes that could not be reached along with the part of the ring
+// they were responsible for forwarding to
+type Aggregate struct {
+	Nodes, Keys int
+	MinLoad, MaxLoad int
+	MinNode, MaxNode string
+	Members []string
+	Failed []string
+}
+
+// broadcastLog remembers recent broadcasts so inconsistent fingers can't
+// deliver one twice
+type broadcastLog struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func (l *broadcastLog) first(id string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for k, t := range l.seen {
+		if now.Sub(t) > time.Minute {
+			delete(l.seen, k)
+		}
+	}
+	if _, ok := l.seen[id]; ok {
+		return false
+	}
+	l.seen[id] = now
+	return true
+}
+
+func (a *Aggregate) merge(b Aggregate) {
+	a.Failed = append(a.Failed, b.Failed...)
+	if b.Nodes == 0 {
+		return
+	}
+	if a.Nodes == 0 || b.MinLoad < a.MinLoad {
+		a.MinLoad, a.MinNode = b.MinLoad, b.MinNode
+	}
+	if a.Nodes == 0 || b.MaxLoad > a.MaxLoad {
+		a.MaxLoad, a.MaxNode = b.MaxLoad, b.MaxNode
+	}
+	a.Nodes += b.Nodes
+	a.Keys += b.Keys
+	a.Members = append(a.Members, b.Members...)
+}
+
+// distance is how far clockwise id lies from n
+func (n *Node) distance(id *big.Int) *big.Int {
+	d := new(big.Int).Sub(id, n.id)
+	return d.Mod(d, hashMod)
+}
+
+// children splits the part of the ring between n and limit among n's
+// successor and fingers: each child covers the ring up to the next one
+func (n *Node) children(limit string) []string {
+	end := n.idOf(limit)
+	seen := map[string]bool{n.IP: true}
+	var nodes []string
+	candidates := append([]string{n.successor[0]}, n.finger[1:]...)
+	for _, addr := range candidates {
+		if addr == "" || seen[addr] || !between(n.id, n.idOf(addr), end, false) {
+			continue
+		}
+		seen[addr] = true
+		nodes = append(nodes, addr)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return n.distance(n.idOf(nodes[i])).Cmp(n.distance(n.idOf(nodes[j]))) < 0
+	})
+	return nodes
+}
+
+// Broadcast exported
+// delivers the message at n, forwards it to n's share of the ring, and
+// answers once every child has acked with its own aggregate
+func (n *Node) Broadcast(args BroadcastArgs, reply *Aggregate) error {
+	if !n.verify(args.Auth, "", "broadcast", args.ID) {
+		n.auth.reject("broadcast")
+		return errors.New("broadcast: not signed by a ring member")
+	}
+	if !n.broadcasts.first(args.ID) {
+		return nil
+	}
+	if args.Msg != "" {
+		Blue.Printf("%v Broadcast from %v: %v\n", TimeClock(), args.From, args.Msg)
+	}
+	n.dataLock.Lock()
+	keys := len(n.data)
+	n.dataLock.Unlock()
+	*reply = Aggregate {
+		Nodes: 1,
+		Keys: keys,
+		MinLoad: keys,
+		MaxLoad: keys,
+		MinNode: n.IP,
+		MaxNode: n.IP,
+		Members: []string{n.IP},
+	}
+	children := n.children(args.Limit)
+	results := make([]Aggregate, len(children))
+	var wg sync.WaitGroup
+	for i, child := range children {
+		forward := args
+		if i + 1 < len(children) {
+			forward.Limit = children[i + 1]
+		}
+		wg.Add(1)
+		go func(i int, child string, forward BroadcastArgs) {
+			defer wg.Done()
+			err := n.rpcBroadcast(child, forward, &results[i])
+			if err != nil {
+				Cyan.Println(TimeClock(), "broadcast:", err, "to", child)
+				results[i] = Aggregate{Failed: []string{child + " (up to " + forward.Limit + ")"}}
+			}
+		}(i, child, forward)
+	}
+	wg.Wait()
+	for _, r := range results {
+		reply.merge(r)
+	}
+	return nil
+}
+
+func (n *Node) rpcBroadcast(addr string, args BroadcastArgs, reply *Aggregate) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("broadcast: client offline")
+	}
+	defer client.Close()
+	args.Auth = n.sign("broadcast", args.ID)
+	return client.Call("Node.Broadcast", args, reply)
+}
+
+// broadcast sends msg to every node, n included, and aggregates their acks;
+// members come back in ring order starting at n
+func (n *Node) broadcast(msg string) (*Aggregate, error) {
+	args := BroadcastArgs {
+		ID: fmt.Sprintf("%v#%v", n.IP, time.Now().UnixNano()),
+		From: n.IP,
+		Msg: msg,
+		Limit: n.IP,
+	}
+	var reply Aggregate
+	err := n.rpcBroadcast(n.IP, args, &reply)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(reply.Members, func(i, j int) bool {
+		return n.distance(n.idOf(reply.Members[i])).Cmp(n.distance(n.idOf(reply.Members[j]))) < 0
+	})
+	return &reply, nil
+}
+
+// Broadcast exported
+// sends msg to every node and collects their acks
+func (c *Chord) Broadcast(msg string) (*Aggregate, error) {
+	if c.Node == nil {
+		return nil, errors.New("Broadcast: have not created or joined")
+	}
+	return c.Node.broadcast(msg)
+}
+
+// Aggregate exported
+// collects key counts, load and membership from every node
+func (c *Chord) Aggregate() (*Aggregate, error) {
+	return c.Broadcast("")
+}
+
+// BroadcastCmd exported
+func (c *Chord) BroadcastCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Broadcast: expect message")
+	}
+	a, err := c.Broadcast(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Broadcast acked by %v nodes\n", TimeClock(), a.Nodes)
+	if len(a.Failed) > 0 {
+		Yellow.Printf("%v Broadcast failed at %v\n", TimeClock(), a.Failed)
+	}
+	return nil
+}
+
+// StatsCmd exported
+func (c *Chord) StatsCmd(args ...string) error {
+	a, err := c.Aggregate()
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Ring: %v nodes, %v keys\n", TimeClock(), a.Nodes, a.Keys)
+	Magenta.Printf("%v Load: min %v at %v, max %v at %v\n", TimeClock(), a.MinLoad, a.MinNode, a.MaxLoad, a.MaxNode)
+	Magenta.Printf("%v Members: %v\n", TimeClock(), a.Members)
+	if len(a.Failed) > 0 {
+		Yellow.Printf("%v Unreachable: %v\n", TimeClock(), a.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+// cacheSize bounds how many owner ranges a node remembers
+const cacheSize = 256
+
+// ownerRange says that addr owns the keys in (start, end]
+type ownerRange struct {
+	start, end *big.Int
+	addr string
+	used time.Time
+}
+
+// lookupCache remembers which node owns which part of the ring, learned
+// from lookups and from the ring maintenance, so that keys looked up
+// before reach their owner in one hop
+type lookupCache struct {
+	lock sync.Mutex
+	ranges map[string]*ownerRange
+}
+
+// learn records that owner owns the keys after pred up to itself, dropping
+// whatever that contradicts
+func (c *lookupCache) learn(n *Node, pred, owner string) {
+	if pred == "" || owner == "" {
+		return
+	}
+	r := &ownerRange {
+		start: n.idOf(pred),
+		end: n.idOf(owner),
+		addr: owner,
+		used: time.Now(),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for addr, old := range c.ranges {
+		if addr == owner {
+			continue
+		}
+		if between(r.start, old.end, r.end, true) || between(old.start, r.end, old.end, true) {
+			delete(c.ranges, addr)
+		}
+	}
+	if _, ok := c.ranges[owner]; !ok && len(c.ranges) >= cacheSize {
+		oldest := ""
+		for addr, old := range c.ranges {
+			if oldest == "" || old.used.Before(c.ranges[oldest].used) {
+				oldest = addr
+			}
+		}
+		delete(c.ranges, oldest)
+	}
+	c.ranges[owner] = r
+}
+
+// owner returns the cached owner of key, or "" when none is known
+func (c *lookupCache) owner(key string) string {
+	id := hashString(key)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for addr, r := range c.ranges {
+		if between(r.start, id, r.end, true) {
+			r.used = time.Now()
+			return addr
+		}
+	}
+	return ""
+}
+
+func (c *lookupCache) forget(addr string) {
+	c.lock.Lock()
+	delete(c.ranges, addr)
+	c.lock.Unlock()
+}
+
+// route finds the owner of key, from the cache when it can; secure lookups
+// never trust the cache
+func (n *Node) route(key string) (string, bool, error) {
+	if n.secure == 0 {
+		if addr := n.cache.owner(key); addr != "" {
+			return addr, true, nil
+		}
+	}
+	addr, err := n.lookup(key)
+	if err != nil || n.secure > 0 {
+		return addr, false, err
+	}
+	pred, err := n.rpcGetPredecessor(addr)
+	if err == nil {
+		n.cache.learn(n, pred, addr)
+	}
+	return addr, false, nil
+}
+
+// callOwner calls method about key on its owner, found through the cache
+// when possible; an owner from the cache that is gone is forgotten and the
+// key looked up again
+func (n *Node) callOwner(key, method string, args, reply interface{}) (string, error) {
+	for {
+		addr, cached, err := n.route(key)
+		if err != nil {
+			return addr, err
+		}
+		answered, err := n.callAt(addr, key, method, args, reply)
+		if cached && answered == addr && isOffline(err) {
+			n.cache.forget(addr)
+			continue
+		}
+		return answered, err
+	}
+}
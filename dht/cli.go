@@ -2,7 +2,12 @@ package dht
 
 import (
 	"time"
+	"sync"
 	"errors"
+	"context"
+	"strconv"
+	"encoding/hex"
+	"crypto/ed25519"
 )
 
 // Chord exported
@@ -10,21 +15,45 @@ type Chord struct {
 	Node *Node 
 	server *rpcServer 
 	port string
+	transport string
+	tls *tlsStore
+	secret []byte
+	policy *IdentityPolicy
+	key ed25519.PrivateKey
+	nonce uint64
+	cert []byte
+	secure int
+	proximity bool
+	hotRate float64
+	balance bool
+	timers *Timers
+	admin ed25519.PublicKey
+	client *clientKey
+	limits *Limits
+	gateway *httpServer
+	resp *respServer
+	memcache *memcacheServer
+	life sync.Mutex
+	state State
 }
 
 // HelpCmd exported
 func (c *Chord) HelpCmd(args ...string) error {
-	Magenta.Println(TimeClock(), "Available commands: help, quit, port, create, join, dump, put, get, delete")
+	Magenta.Println(TimeClock(), "Available commands: help, quit, port, transport, tls, cert, secret, identity, certify, secure, proximity, hot, balance, timers, acl, client, limit, create, join, dump, stats, broadcast, put, get, delete, archive, retrieve, lock, renew, unlock, ls, put-file, get-file, rm, watch, unwatch, subscribe, unsubscribe, publish, http, resp, memcache")
 	return nil 
 } 
 
 // CreateCmd exported
 func (c *Chord) CreateCmd(args ...string) error {
-	if c.Node != nil {
+	if c.Node != nil || c.State() != Stopped {
 		return errors.New("Create: have created or joined")
 	}
-	c.dispatch()
-	err := c.server.listen()
+	err := c.dispatch()
+	if err != nil {
+		c.Node = nil
+		return err
+	}
+	err = c.launch(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -35,67 +64,82 @@ func (c *Chord) CreateCmd(args ...string) error {
 
 // QuitCmd exported
 func (c *Chord) QuitCmd(args ...string) error {
-	defer Magenta.Printf("%v Quit normally from %v\n", TimeClock(), c.Node.IP)
-	if c.server != nil {
-		defer c.server.quit()
-		for _, suc := range c.Node.successor {
-			status := ping(suc)
-			if !status {
-				continue
-			}
-			err := c.Node.migrateWhenQuiting(suc)
-			if err != nil {
-				continue
-			}
-			break
-		}
-	}
-	c.Node = nil
-	c.server = nil
-	return nil
+	return c.Shutdown(context.Background())
 }
 
 // ForceQuitCmd exported
 func (c *Chord) ForceQuitCmd(args ...string) error {
 	// debug backup function
 	// in real circumstance, these won't be executed
-	c.Node.bufferWriter.Flush()
-	defer Yellow.Printf("%v Force Quit from %v\n", TimeClock(), c.Node.IP)
-	if c.server != nil {
-		defer c.server.forceQuit()
+	c.life.Lock()
+	if c.state != Running {
+		c.life.Unlock()
+		return nil
 	}
+	c.state = Stopping
+	c.life.Unlock()
+	c.closeFrontEnds()
+	ip := c.Node.IP
+	c.Node.bufferWriter.Flush()
+	c.server.forceQuit()
 	c.Node = nil
 	c.server = nil
+	c.setState(Stopped)
+	Yellow.Printf("%v Force Quit from %v\n", TimeClock(), ip)
 	return nil
 }
 
+func (c *Chord) closeFrontEnds() {
+	if c.gateway != nil {
+		c.gateway.quit()
+		c.gateway = nil
+	}
+	if c.resp != nil {
+		c.resp.quit()
+		c.resp = nil
+	}
+	if c.memcache != nil {
+		c.memcache.quit()
+		c.memcache = nil
+	}
+}
+
 func (c *Chord) recover() {
-	time.Sleep(1 * time.Second)
-	for key, value := range c.Node.backup {
+	n := c.Node
+	if !n.pause(1 * time.Second) {
+		return
+	}
+	for key, value := range n.backup {
+		if !n.listening {
+			return
+		}
 		err := c.PutCmd(key, value)
 		if err != nil {
 			Magenta.Printf("%v Fail to recover data (%v, %v)\n", TimeClock(), key, value)
 		} else {
-			Green.Printf("%v Recover (%v, %v) from %v\n", TimeClock(), key, value, c.Node.IP)
+			Green.Printf("%v Recover (%v, %v) from %v\n", TimeClock(), key, value, n.IP)
 		}
-		delete(c.Node.backup, key)
+		delete(n.backup, key)
 	}
 }
 
 // JoinCmd exported
 func (c *Chord) JoinCmd(args ...string) error {
-	if c.Node != nil {
+	if c.Node != nil || c.State() != Stopped {
 		return errors.New("Join: have created or joined")
 	}
 	if len(args) < 1 {
 		return errors.New("Join: lack valid address")
 	}
-	c.dispatch()
-	err := c.server.join(args[0])
+	err := c.dispatch()
+	if err != nil {
+		c.Node = nil
+		return err
+	}
+	err = c.launch(context.Background(), args[0])
 	if err != nil {
 		panic(err)
 	}
-	go c.recover()
 	Magenta.Printf("%v Join at %v\n", TimeClock(), args[0])
 	return nil
 }
@@ -114,20 +158,284 @@ func (c *Chord) PortCmd(args ...string) error {
 	return nil
 }
 
+// TransportCmd exported
+func (c *Chord) TransportCmd(args ...string) error {
+	if len(args) < 1 {
+		Magenta.Printf("%v Current transport is %v\n", TimeClock(), c.transport)
+		return nil
+	}
+	if c.Node != nil {
+		return errors.New("Can't change transport now")
+	}
+	if args[0] != TransportRPC && args[0] != TransportGRPC {
+		return errors.New("Transport: expect rpc or grpc")
+	}
+	c.transport = args[0]
+	Magenta.Printf("%v Transport set to %v\n", TimeClock(), c.transport)
+	return nil
+}
+
+// TLSCmd exported
+func (c *Chord) TLSCmd(args ...string) error {
+	if len(args) < 1 {
+		if c.tls == nil {
+			Magenta.Printf("%v TLS is off\n", TimeClock())
+		} else {
+			Magenta.Printf("%v TLS uses %v, %v and CA %v\n", TimeClock(), c.tls.certFile, c.tls.keyFile, c.tls.caFile)
+		}
+		return nil
+	}
+	if args[0] == "reload" {
+		if c.tls == nil {
+			return errors.New("TLS: not configured")
+		}
+		return c.tls.reload()
+	}
+	if c.Node != nil {
+		return errors.New("Can't change TLS now")
+	}
+	if args[0] == "off" {
+		c.tls = nil
+		return nil
+	}
+	if len(args) < 3 {
+		return errors.New("TLS: expect certificate, key and CA bundle files")
+	}
+	store, err := newtlsStore(args[0], args[1], args[2])
+	if err != nil {
+		return err
+	}
+	c.tls = store
+	Magenta.Printf("%v TLS set to %v\n", TimeClock(), args[0])
+	return nil
+}
+
+// SecretCmd exported
+func (c *Chord) SecretCmd(args ...string) error {
+	if c.Node != nil {
+		return errors.New("Can't change secret now")
+	}
+	if len(args) < 1 || args[0] == "" {
+		c.secret = nil
+		Magenta.Printf("%v Membership authentication off\n", TimeClock())
+		return nil
+	}
+	c.secret = []byte(args[0])
+	Magenta.Printf("%v Membership authentication on\n", TimeClock())
+	return nil
+}
+
+// IdentityCmd exported
+// identity off | identity <difficulty> [admin-public-key cert], keys in hex;
+// the node key is kept across calls so that an admin can certify it
+func (c *Chord) IdentityCmd(args ...string) error {
+	if c.Node != nil {
+		return errors.New("Can't change identity now")
+	}
+	if len(args) < 1 || args[0] == "off" {
+		c.policy = nil
+		Magenta.Printf("%v Node IDs from addresses\n", TimeClock())
+		return nil
+	}
+	difficulty, err := strconv.Atoi(args[0])
+	if err != nil || difficulty < 0 || difficulty > 32 {
+		return errors.New("Identity: expect difficulty between 0 and 32")
+	}
+	policy := &IdentityPolicy{Difficulty: difficulty}
+	var cert []byte
+	if len(args) >= 3 {
+		admin, err := hex.DecodeString(args[1])
+		if err != nil || len(admin) != ed25519.PublicKeySize {
+			return errors.New("Identity: bad admin public key")
+		}
+		cert, err = hex.DecodeString(args[2])
+		if err != nil {
+			return errors.New("Identity: bad certificate")
+		}
+		policy.Admin = admin
+	} else if len(args) == 2 {
+		return errors.New("Identity: expect both admin public key and certificate")
+	}
+	if c.key == nil {
+		_, c.key, err = NewIdentityKey()
+		if err != nil {
+			return err
+		}
+	}
+	pub := c.key.Public().(ed25519.PublicKey)
+	if c.policy == nil || c.policy.Difficulty != difficulty {
+		c.nonce = MineIdentity(pub, difficulty)
+	}
+	c.policy, c.cert = policy, cert
+	Magenta.Printf("%v Node IDs from key %v, nonce %v\n", TimeClock(), hex.EncodeToString(pub), c.nonce)
+	return nil
+}
+
+// CertifyCmd exported
+// certify <admin-private-key> <address> <node-public-key> <nonce>, keys in
+// hex and the nonce as printed by identity; with no arguments it prints a
+// fresh admin key pair
+func (c *Chord) CertifyCmd(args ...string) error {
+	if len(args) == 0 {
+		pub, key, err := NewIdentityKey()
+		if err != nil {
+			return err
+		}
+		Magenta.Printf("%v Admin public key %v\n", TimeClock(), hex.EncodeToString(pub))
+		Magenta.Printf("%v Admin private key %v\n", TimeClock(), hex.EncodeToString(key))
+		return nil
+	}
+	if len(args) < 4 {
+		return errors.New("Certify: expect admin key, address, node key and nonce")
+	}
+	admin, err := hex.DecodeString(args[0])
+	if err != nil || len(admin) != ed25519.PrivateKeySize {
+		return errors.New("Certify: bad admin private key")
+	}
+	pub, err := hex.DecodeString(args[2])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("Certify: bad node public key")
+	}
+	nonce, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil {
+		return errors.New("Certify: bad nonce")
+	}
+	Magenta.Printf("%v Certificate %v\n", TimeClock(), hex.EncodeToString(CertifyNode(admin, args[1], pub, nonce)))
+	return nil
+}
+
+// SecureCmd exported
+// secure <paths> | secure off
+func (c *Chord) SecureCmd(args ...string) error {
+	paths := 0
+	if len(args) > 0 && args[0] != "off" {
+		var err error
+		paths, err = strconv.Atoi(args[0])
+		if err != nil || paths < 1 {
+			return errors.New("Secure: expect number of lookup paths")
+		}
+	}
+	c.secure = paths
+	if c.Node != nil {
+		c.Node.secure = paths
+	}
+	if paths == 0 {
+		Magenta.Printf("%v Secure lookup off\n", TimeClock())
+	} else {
+		Magenta.Printf("%v Secure lookup through %v paths\n", TimeClock(), paths)
+	}
+	return nil
+}
+
+// ProximityCmd exported
+// proximity on | off picks fingers and next hops by round trip time
+func (c *Chord) ProximityCmd(args ...string) error {
+	if len(args) < 1 || args[0] != "on" && args[0] != "off" {
+		return errors.New("Proximity: expect on or off")
+	}
+	c.proximity = args[0] == "on"
+	if c.Node != nil {
+		c.Node.proximity = c.proximity
+	}
+	Magenta.Printf("%v Proximity routing %v\n", TimeClock(), args[0])
+	return nil
+}
+
+// ACLCmd exported
+// acl <admin-public-key> enforces the ACL the admin publishes; acl off
+func (c *Chord) ACLCmd(args ...string) error {
+	if c.Node != nil {
+		return errors.New("Can't change ACL now")
+	}
+	if len(args) < 1 || args[0] == "off" {
+		c.admin = nil
+		Magenta.Printf("%v Access control off\n", TimeClock())
+		return nil
+	}
+	admin, err := hex.DecodeString(args[0])
+	if err != nil || len(admin) != ed25519.PublicKeySize {
+		return errors.New("ACL: bad admin public key")
+	}
+	c.admin = admin
+	Magenta.Printf("%v Access control on\n", TimeClock())
+	return nil
+}
+
+// ClientCmd exported
+// client <name> <private-key> signs requests as name; client off
+func (c *Chord) ClientCmd(args ...string) error {
+	if len(args) < 1 || args[0] == "off" {
+		c.client = nil
+	} else if len(args) < 2 {
+		return errors.New("Client: expect name and private key")
+	} else {
+		key, err := hex.DecodeString(args[1])
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return errors.New("Client: bad private key")
+		}
+		c.client = &clientKey{name: args[0], key: key}
+	}
+	if c.Node != nil {
+		c.Node.client = c.client
+	}
+	if c.client == nil {
+		Magenta.Printf("%v Anonymous client\n", TimeClock())
+	} else {
+		Magenta.Printf("%v Client %v\n", TimeClock(), c.client.name)
+	}
+	return nil
+}
+
+// LimitCmd exported
+// limit <client-rate> [method-rate [maintenance-rate]] in calls per second,
+// 0 meaning unlimited; limit off
+func (c *Chord) LimitCmd(args ...string) error {
+	if len(args) < 1 || args[0] == "off" {
+		c.limits = nil
+		if c.Node != nil {
+			c.Node.limits = nil
+		}
+		Magenta.Printf("%v Rate limits off\n", TimeClock())
+		return nil
+	}
+	rates := []float64{0, 0, 0}
+	for i := 0; i < len(args) && i < 3; i++ {
+		rate, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || rate < 0 {
+			return errors.New("Limit: expect rates in calls per second")
+		}
+		rates[i] = rate
+	}
+	c.limits = &Limits{Client: rates[0], Method: rates[1], Maintenance: rates[2]}
+	if c.Node != nil {
+		c.Node.limits = newlimiter(*c.limits)
+	}
+	Magenta.Printf("%v Rate limits %v per client, %v per method, %v for maintenance\n", TimeClock(), rates[0], rates[1], rates[2])
+	return nil
+}
+
+// CertCmd exported
+func (c *Chord) CertCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Cert: expect directory and node names")
+	}
+	err := GenerateCerts(args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Certificates for %v written to %v\n", TimeClock(), args[1:], args[0])
+	return nil
+}
+
 // PutCmd exported
 func (c *Chord) PutCmd(args ...string) error {
-	addr := c.Node.find(args[0])
-	client := dial(addr)
-	if client == nil {
-		return errors.New("Put: client offline")
-	}
-	defer client.Close()
 	putArgs := PutArgs { 
 		Key: args[0],
 		Val: args[1],
+		Cred: c.Node.credential(PermWrite, args[0], args[1]),
 	}
 	var reply bool
-	err := client.Call("Node.Put", putArgs, &reply) 
+	addr, err := c.Node.callOwner(args[0], "Put", putArgs, &reply)
 	if err != nil {
 		return err 
 	}
@@ -137,21 +445,16 @@ func (c *Chord) PutCmd(args ...string) error {
 
 // GetCmd exported
 func (c *Chord) GetCmd(args ...string) error {
-	addr := c.Node.find(args[0])
-	client := dial(addr)
-	if client == nil {
-		return errors.New("Get: client offline")
-	}
-	defer client.Close() 
-	var reply string 
-	err := client.Call("Node.Get", args[0], &reply)
+	reply, err := c.Node.read(args[0])
 	if err != nil {
 		return err 
 	}
-	if reply != "" {
-		Magenta.Printf("%v Get (%v, %v) at %v\n", TimeClock(), args[0], reply, addr)
+	if reply.Val != "" && reply.Replica {
+		Magenta.Printf("%v Get (%v, %v) from replica at %v\n", TimeClock(), args[0], reply.Val, reply.From)
+	} else if reply.Val != "" {
+		Magenta.Printf("%v Get (%v, %v) at %v\n", TimeClock(), args[0], reply.Val, reply.From)
 	} else {
-		Yellow.Printf("%v Fail to get %v at %v\n", TimeClock(), args[0], addr)
+		Yellow.Printf("%v Fail to get %v at %v\n", TimeClock(), args[0], reply.From)
 		return errors.New("Get: match not found")
 	}
 	return nil
@@ -159,14 +462,8 @@ func (c *Chord) GetCmd(args ...string) error {
 
 // DeleteCmd exported
 func (c *Chord) DeleteCmd(args ...string) error {
-	addr := c.Node.find(args[0])
-	client := dial(addr)
-	if client == nil {
-		return errors.New("Delete: client offline")
-	}
-	defer client.Close()
 	var reply bool
-	err := client.Call("Node.Delete", args[0], &reply)
+	addr, err := c.Node.callOwner(args[0], "Delete", KeyArgs{Key: args[0], Cred: c.Node.credential(PermDelete, args[0], "")}, &reply)
 	if err != nil {
 		return err
 	}
@@ -179,6 +476,146 @@ func (c *Chord) DeleteCmd(args ...string) error {
 	return nil
 }
 
+// ArchiveCmd exported
+// archive <key> <value> [m n] stores value erasure coded into n fragments,
+// 2 of 4 by default, on the owner of key and its successors
+func (c *Chord) ArchiveCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Archive: expect key and value")
+	}
+	need, total := 2, 4
+	if len(args) >= 4 {
+		var err1, err2 error
+		need, err1 = strconv.Atoi(args[2])
+		total, err2 = strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil {
+			return errors.New("Archive: expect m and n as numbers")
+		}
+	}
+	err := c.Node.putErasure(args[0], []byte(args[1]), need, total)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Archived (%v, %v) as %v of %v fragments\n", TimeClock(), args[0], args[1], need, total)
+	return nil
+}
+
+// RetrieveCmd exported
+func (c *Chord) RetrieveCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Retrieve: expect key")
+	}
+	val, err := c.Node.getErasure(args[0])
+	if err != nil {
+		Yellow.Printf("%v Fail to retrieve %v: %v\n", TimeClock(), args[0], err)
+		return err
+	}
+	Magenta.Printf("%v Retrieved (%v, %v)\n", TimeClock(), args[0], string(val))
+	return nil
+}
+
+// WatchCmd exported
+func (c *Chord) WatchCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Watch: lack valid key")
+	}
+	prefix := false
+	if args[0] == "-p" {
+		if len(args) < 2 {
+			return errors.New("Watch: lack valid prefix")
+		}
+		prefix = true
+		args = args[1:]
+	}
+	w, err := c.Watch(args[0], prefix)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Watch %v on %v\n", TimeClock(), w.ID, w.Key)
+	go func() {
+		for ev := range w.Events {
+			if ev.Missed {
+				Yellow.Printf("%v Watch %v may have missed events before seq %v\n", TimeClock(), ev.ID, ev.Seq)
+			}
+			if ev.Type != EventMissed {
+				Blue.Printf("%v Watch %v: %v (%v, %v) at %v\n", TimeClock(), ev.ID, ev.Type, ev.Key, ev.Val, ev.From)
+			}
+		}
+	}()
+	return nil
+}
+
+// UnwatchCmd exported
+func (c *Chord) UnwatchCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Unwatch: lack valid watch id")
+	}
+	return c.Unwatch(args[0])
+}
+
+// HTTPCmd exported
+func (c *Chord) HTTPCmd(args ...string) error {
+	if c.Node == nil {
+		return errors.New("HTTP: have not created or joined")
+	}
+	if c.gateway != nil {
+		return errors.New("HTTP: gateway already listening at " + c.gateway.addr)
+	}
+	if len(args) < 1 {
+		return errors.New("HTTP: lack valid port")
+	}
+	gateway := newhttpServer(c.Node, args[0])
+	err := gateway.listen()
+	if err != nil {
+		return err
+	}
+	c.gateway = gateway
+	Magenta.Printf("%v HTTP gateway listening at %v\n", TimeClock(), gateway.addr)
+	return nil
+}
+
+// RESPCmd exported
+func (c *Chord) RESPCmd(args ...string) error {
+	if c.Node == nil {
+		return errors.New("RESP: have not created or joined")
+	}
+	if c.resp != nil {
+		return errors.New("RESP: already listening at " + c.resp.addr)
+	}
+	if len(args) < 1 {
+		return errors.New("RESP: lack valid port")
+	}
+	resp := newrespServer(c.Node, args[0])
+	err := resp.listen()
+	if err != nil {
+		return err
+	}
+	c.resp = resp
+	Magenta.Printf("%v RESP front-end listening at %v\n", TimeClock(), resp.addr)
+	return nil
+}
+
+// MemcacheCmd exported
+func (c *Chord) MemcacheCmd(args ...string) error {
+	if c.Node == nil {
+		return errors.New("Memcache: have not created or joined")
+	}
+	if c.memcache != nil {
+		return errors.New("Memcache: already listening at " + c.memcache.addr)
+	}
+	if len(args) < 1 {
+		return errors.New("Memcache: lack valid port")
+	}
+	memcache := newmemcacheServer(c.Node, args[0])
+	err := memcache.listen()
+	if err != nil {
+		return err
+	}
+	c.memcache = memcache
+	Magenta.Printf("%v Memcached front-end listening at %v\n", TimeClock(), memcache.addr)
+	return nil
+}
+
 // DumpCmd exported
 func (c *Chord) DumpCmd(args ...string) error {
 	c.server.dump()
@@ -187,6 +624,39 @@ func (c *Chord) DumpCmd(args ...string) error {
 
 func (c *Chord) dispatch() error {
 	c.Node = newNode(c.port)
+	c.Node.transport = c.transport
+	c.Node.tls = c.tls
+	c.Node.secret = c.secret
+	c.Node.secure = c.secure
+	c.Node.proximity = c.proximity
+	if c.hotRate != 0 {
+		c.Node.hotRate = c.hotRate
+	}
+	if c.timers != nil {
+		c.Node.upkeep = newupkeep(*c.timers)
+	}
+	if c.balance {
+		if c.policy != nil {
+			return errors.New("Balance: node IDs are key based")
+		}
+		c.Node.balance = &balancer{}
+	}
+	c.Node.client = c.client
+	if c.limits != nil {
+		c.Node.limits = newlimiter(*c.limits)
+	}
+	if c.admin != nil {
+		if c.secret == nil {
+			return errors.New("ACL: needs a ring secret")
+		}
+		c.Node.acl = &aclState{admin: c.admin, nonces: make(map[string]time.Time)}
+	}
+	if c.policy != nil {
+		err := c.Node.setIdentity(c.policy, c.key, c.nonce, c.cert)
+		if err != nil {
+			return err
+		}
+	}
 	c.Node.getBackup()
 	c.Node.startBackup()
 	c.server = newrpcServer(c.Node)
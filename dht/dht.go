@@ -1,8 +1,10 @@
 package dht
 
 import (
+	"context"
 	"strings"
 	"errors"
+	"crypto/tls"
 	"math/big"
 	"net"
 	"net/rpc"
@@ -10,6 +12,7 @@ import (
 	"bufio"
 	"os"
 	"io/ioutil"
+	"sync"
 )
 
 // Node exported
@@ -17,27 +20,113 @@ type Node struct {
 	successor [3]string
 	IP, predecessor string
 	data, backup map[string]string
+	expiry map[string]time.Time
+	flags map[string]uint32
+	version map[string]uint64
+	clock uint64
+	dataLock sync.Mutex
 	id *big.Int
 	listening bool
+	transport string
+	tls *tlsStore
+	secret []byte
+	auth authStats
+	policy *IdentityPolicy
+	identity Identity
+	ids identityCache
+	secure int
+	proximity bool
+	rtt rttTable
+	cache lookupCache
+	transfers transferLog
+	heat heatTable
+	replicas replicaStore
+	hotRate float64
+	balance *balancer
+	// moving is the node to redirect to while n moves to another ID
+	moving string
+	acl *aclState
+	client *clientKey
+	limits *limiter
+	fragments fragmentStore
+	leases leaseStore
+	broadcasts broadcastLog
+	topics topicStore
 	next int
 	finger [161]string
+	upkeep upkeep
+	stopped chan struct{}
+	stopOnce sync.Once
+	// calls are the RPCs n is serving, tasks its background work
+	calls, tasks inflight
 	bufferWriter *bufio.Writer
 	file *os.File
+	watchers map[string]*WatchArgs
+	watching map[string]*Watch
+	watchLock sync.Mutex
+	events chan WatchEvent
 }
 
 // PutArgs exported
 type PutArgs struct {
 	Key, Val string
+	Flags uint32
+	// Version is kept by migration; puts from clients get a fresh one
+	Version uint64
+	// Cred signs puts from clients, Auth migrations between nodes
+	Cred Cred
+	Auth Auth
+}
+
+// ExpireArgs exported
+type ExpireArgs struct {
+	Key string
+	TTL time.Duration
+	Cred Cred
+	Auth Auth
 }
 
 func newNode(port string) *Node {
-	addr := getLocalAddress()
+	addr := GetLocalAddress()
 	ip := addr + ":" + port
 	return &Node {
 		IP: ip,
 		data: make(map[string]string),
 		backup: make(map[string]string),
+		expiry: make(map[string]time.Time),
+		flags: make(map[string]uint32),
+		version: make(map[string]uint64),
 		id: hashString(ip),
+		watchers: make(map[string]*WatchArgs),
+		watching: make(map[string]*Watch),
+		events: make(chan WatchEvent, 1024),
+		auth: authStats{rejected: make(map[string]int)},
+		ids: identityCache{ids: make(map[string]verifiedID)},
+		rtt: rttTable{samples: make(map[string]rttSample)},
+		cache: lookupCache{ranges: make(map[string]*ownerRange)},
+		transfers: transferLog{transfers: make(map[string]*Transfer)},
+		heat: heatTable{hits: make(map[string]int), rates: make(map[string]float64)},
+		replicas: replicaStore {
+			held: make(map[string]*replica),
+			holders: make(map[string]map[string]time.Time),
+			hints: make(map[string]replicaHint),
+			hot: make(map[string]bool),
+		},
+		hotRate: defaultHotRate,
+		upkeep: newupkeep(DefaultTimers),
+		stopped: make(chan struct{}),
+		fragments: fragmentStore{frags: make(map[string]Fragment)},
+		broadcasts: broadcastLog{seen: make(map[string]time.Time)},
+		topics: topicStore {
+			subscribers: make(map[string]map[string]string),
+			seq: make(map[string]uint64),
+			subscribed: make(map[string]*Subscription),
+		},
+		leases: leaseStore {
+			leases: make(map[string]Lease),
+			seen: make(map[string]time.Time),
+			held: make(map[string]*Lock),
+		},
 	}
 }
 
@@ -70,8 +159,8 @@ func (n *Node) getBackup() error {
 	return nil
 }
 
-func ping(addr string) (bool) {
-	client := dial(addr)
+func (n *Node) ping(addr string) (bool) {
+	client := n.dial(addr)
 	if client == nil {
 		return false
 	} 
@@ -84,23 +173,34 @@ func ping(addr string) (bool) {
 	return true
 }
 
-func (n *Node) stabilize() {
+// stabilize reports whether the successor list changed or a successor
+// failed
+func (n *Node) stabilize() bool {
+	if n.moving != "" {
+		return false
+	}
+	before := n.successor
+	failed := false
 	for _, suc := range n.successor {
-		status := ping(suc)
+		status := n.ping(suc)
 		if !status {
+			failed = true
 			continue
 		}
 		n.successor[0] = suc
-		x, err := rpcGetPredecessor(suc)
+		x, err := n.rpcGetPredecessor(suc)
 		if err == nil {
-			if between(n.id, hashString(x), hashString(suc), false) {
+			if between(n.id, n.idOf(x), n.idOf(suc), false) && n.trusted(x, "stabilize") {
 				n.successor[0] = x
+				n.cache.learn(n, n.IP, x)
 			}
+			n.cache.learn(n, x, suc)
 		} else {
 			Cyan.Println(TimeClock(), "stabilize:", err, "from", suc, "at", n.IP)
+			failed = true
 		}
 		ok := true
-		client := dial(suc)
+		client := n.dial(suc)
 		if client == nil {
 			continue
 		}
@@ -110,64 +210,78 @@ func (n *Node) stabilize() {
 			if err != nil {
 				Cyan.Println(TimeClock(), "stabilize: pass successor", err, "from", suc)
 				ok = false
+				failed = true
 			}
 		}
 		if !ok {
 			continue
 		}
-		err = rpcNotify(n.successor[0], n.IP)
+		err = n.rpcNotify(n.successor[0], n.IP)
 		if err != nil {
 			Cyan.Println(TimeClock(), "stabilize:", err, "when notifying", n.successor[0], "at", n.IP)
+			failed = true
 		}
 		break
 	}
+	return failed || n.successor != before
 }
 
-func (n *Node) checkPredecessor() {
-	status := ping(n.predecessor)
-	if !status {
+// checkPredecessor reports whether the predecessor failed
+func (n *Node) checkPredecessor() bool {
+	status := n.ping(n.predecessor)
+	if !status && n.predecessor != "" {
 		n.predecessor = ""
+		return true
 	}
+	return false
 }
 
-func (n *Node) fixFingers() {
+// fixFingers reports whether the finger it refreshed changed
+func (n *Node) fixFingers() bool {
+	if n.moving != "" {
+		return false
+	}
 	n.next++
 	if (n.next > 160) {
 		n.next = 1
 	}
-	n.finger[n.next], _ = rpcFindSuccessor(n.IP, jump(n.IP, n.next))
+	finger, err := n.rpcFindSuccessor(n.IP, jump(n.id, n.next))
+	if n.proximity {
+		finger = n.proximateFinger(n.next, finger)
+	}
+	changed := err != nil || finger != n.finger[n.next]
+	n.finger[n.next] = finger
+	return changed
 }
 
 func (n *Node) stabilizePeriodically() {
-	period := time.Tick(333 * time.Millisecond)
-	for {
-		if !n.listening {
-			break
-		}
-		<-period
-		n.stabilize()
-	}
+	n.maintain(n.upkeep.stabilize, n.stabilize)
 }
 
 func (n *Node) checkPredecessorPeriodically() {
-	period := time.Tick(333 * time.Millisecond)
-	for {
-		if !n.listening {
-			break
-		}
-		<-period
-		n.checkPredecessor()
-	}
+	n.maintain(n.upkeep.checkPredecessor, n.checkPredecessor)
 }
 
 func (n *Node) fixFingersPeriodically() {
-	period := time.Tick(333 * time.Millisecond)
-	for {
-		if !n.listening {
-			break
+	n.maintain(n.upkeep.fixFingers, n.fixFingers)
+}
+
+func (n *Node) expireKeysPeriodically() {
+	period := time.NewTicker(time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		now := time.Now()
+		var expired []string
+		n.dataLock.Lock()
+		for k, deadline := range n.expiry {
+			if !now.Before(deadline) {
+				expired = append(expired, k)
+			}
+		}
+		n.dataLock.Unlock()
+		for _, k := range expired {
+			n.expire(k)
 		}
-		<-period
-		n.fixFingers()
 	}
 }
 
@@ -176,19 +290,30 @@ func (n *Node) create() {
 	for i := 0; i < 3; i++ {
 		n.successor[i] = n.IP
 	}
-	go n.stabilizePeriodically()
-	go n.checkPredecessorPeriodically()
-	go n.fixFingersPeriodically()
+	n.spawn(n.stabilizePeriodically)
+	n.spawn(n.checkPredecessorPeriodically)
+	n.spawn(n.fixFingersPeriodically)
+	n.spawn(n.expireKeysPeriodically)
+	n.spawn(n.deliverEvents)
+	n.spawn(n.refreshWatchesPeriodically)
+	n.spawn(n.refreshACLPeriodically)
+	n.spawn(n.renewChunksPeriodically)
+	n.spawn(n.repairFragmentsPeriodically)
+	n.spawn(n.maintainLeasesPeriodically)
+	n.spawn(n.refreshSubscriptionsPeriodically)
+	n.spawn(n.forwardStrayKeysPeriodically)
+	n.spawn(n.replicateHotKeysPeriodically)
+	n.spawn(n.rebalancePeriodically)
 }
 
 func (n *Node) join(addr string) error {
 	n.predecessor = ""
-	successor, err := rpcFindSuccessor(addr, hashString(n.IP))
+	successor, err := n.rpcFindSuccessor(addr, n.id)
 	if err != nil {
 		return err
 	}
 	n.successor[0] = successor
-	err = rpcMigrateWhenJoining(successor, n.IP)
+	err = n.rpcMigrateWhenJoining(successor, n.IP)
 	return err
 }
 
@@ -199,49 +324,65 @@ func (n *Node) GetPredecessor(none bool, addr *string) error {
 }
 
 // Notify exported
-func (n *Node) Notify(addr string, reply *bool) error {
-	if n.predecessor == "" || between(hashString(n.predecessor), hashString(addr), n.id, false) {
+func (n *Node) Notify(args Address, reply *bool) error {
+	addr := args.Addr
+	if !n.verify(args.Auth, addr, "notify", addr) {
+		n.auth.reject("notify")
+		Yellow.Println(TimeClock(), "notify: reject unauthenticated", addr, "at", n.IP)
+		return errors.New("notify: unauthenticated")
+	}
+	if !n.trusted(addr, "notify") {
+		return errors.New("notify: unverified node ID")
+	}
+	if n.predecessor == "" || between(n.idOf(n.predecessor), n.idOf(addr), n.id, false) {
+		if n.predecessor != addr {
+			n.neighbourChanged()
+		}
 		n.predecessor = addr
+		n.cache.learn(n, addr, n.IP)
 	}
 	return nil
 }
 
 // FindSuccessor exported
-func (n *Node) FindSuccessor(id *big.Int, reply *string) error {
+func (n *Node) FindSuccessor(id *big.Int, reply *Address) error {
 	for _, suc := range n.successor {
-		status := ping(suc)
+		status := n.ping(suc)
 		if !status {
 			continue
 		}
-		if between(n.id, id, hashString(suc), true) {
-			*reply = suc
+		if between(n.id, id, n.idOf(suc), true) {
+			*reply = Address{Addr: suc, Auth: n.sign("find", id.Text(16), suc)}
 			return nil
 		}
 		break
 	}
 	cpn := n.closestPrecedingNode(id)
 	if cpn != "" {
-		var err error
-		*reply, err = rpcFindSuccessor(cpn, id)
+		addr, err := n.rpcFindSuccessor(cpn, id)
+		*reply = Address{Addr: addr, Auth: n.sign("find", id.Text(16), addr)}
 		return err
 	}
 	return errors.New("find successor: successor not found")
 }
 
 func (n *Node) closestPrecedingNode(id *big.Int) string {
+	if n.proximity {
+		return n.proximateRoute(id)
+	}
 	for i := 160; i > 0; i-- {
-		status := ping(n.finger[i])
+		status := n.ping(n.finger[i])
 		if status {
-			if between(hashString(n.IP), hashString(n.finger[i]), id, false) {
+			if between(n.id, n.idOf(n.finger[i]), id, false) {
 				return n.finger[i]
 			}
 		}
 	}
 	for i := 2; i >= 0; i-- {
 		suc := n.successor[i]
-		status := ping(suc)
+		status := n.ping(suc)
 		if status {
-			if between(hashString(n.IP), hashString(suc), id, false) {
+			if between(n.id, n.idOf(suc), id, false) {
 				return suc
 			}
 		}
@@ -251,78 +392,286 @@ func (n *Node) closestPrecedingNode(id *big.Int) string {
 
 // Put exported
 func (n *Node) Put(args PutArgs, reply *bool) error {
-	n.data[args.Key] = args.Val
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermWrite, args.Key, args.Val)
+	if err != nil {
+		return err
+	}
+	if n.acl != nil && args.Key == aclKey {
+		err = n.acl.admit(args.Val, false)
+		if err != nil {
+			return err
+		}
+	}
+	n.put(args, reply)
+	return nil
+}
+
+func (n *Node) put(args PutArgs, reply *bool) {
+	args.Version = 0
+	n.dataLock.Lock()
+	delete(n.expiry, args.Key)
+	n.saveLocked(args)
+	n.dataLock.Unlock()
 	*reply = true
-	n.bufferWriter.WriteString("0 " + args.Key + " " + args.Val + " ")
+	n.invalidate(args.Key)
+	n.publish(EventPut, args.Key, args.Val)
+}
+
+// Migrate exported
+// stores a key handed over by a neighbour without publishing watch events;
+// a newer copy already held wins
+func (n *Node) Migrate(args PutArgs, reply *bool) error {
+	err := n.allowNode(args.Auth, "migrate", args.Key)
+	if err != nil {
+		return err
+	}
+	n.dataLock.Lock()
+	if version, ok := n.version[args.Key]; ok && version > args.Version {
+		n.dataLock.Unlock()
+		*reply = true
+		return nil
+	}
+	if n.acl != nil && args.Key == aclKey {
+		err = n.acl.admit(args.Val, true)
+		if err != nil {
+			n.dataLock.Unlock()
+			return err
+		}
+	}
+	*reply = true
+	n.saveLocked(args)
+	n.dataLock.Unlock()
+	n.invalidate(args.Key)
 	return nil
 }
 
+// saveLocked stores args and logs it to the backup; callers hold dataLock
+// and invalidate the key's replicas once they let go of it
+func (n *Node) saveLocked(args PutArgs) {
+	n.data[args.Key] = args.Val
+	if args.Flags != 0 {
+		n.flags[args.Key] = args.Flags
+	} else {
+		delete(n.flags, args.Key)
+	}
+	if args.Version == 0 {
+		args.Version = n.nextVersion()
+	} else {
+		n.observe(args.Version)
+	}
+	n.version[args.Key] = args.Version
+	n.bufferWriter.WriteString("0 " + args.Key + " " + args.Val + " ")
+}
+
+// nextVersion hands out increasing versions that stay unique when keys
+// migrate between nodes with their version; callers hold dataLock
+func (n *Node) nextVersion() uint64 {
+	n.clock++
+	if now := uint64(time.Now().UnixNano()); now > n.clock {
+		n.clock = now
+	}
+	return n.clock
+}
+
+// observe makes versions n hands out later rise above version, which came
+// from another node; callers hold dataLock
+func (n *Node) observe(version uint64) {
+	if version > n.clock {
+		n.clock = version
+	}
+}
+
+func (n *Node) putArgs(key string) PutArgs {
+	n.dataLock.Lock()
+	defer n.dataLock.Unlock()
+	return PutArgs {
+		Key: key,
+		Val: n.data[key],
+		Flags: n.flags[key],
+		Version: n.version[key],
+		Auth: n.sign("migrate", key),
+	}
+}
+
 // Get exported
-func (n *Node) Get(key string, reply *string) error {
-	*reply = n.data[key]
+func (n *Node) Get(args KeyArgs, reply *string) error {
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermRead, args.Key, "")
+	if err != nil {
+		return err
+	}
+	n.expire(args.Key)
+	n.heat.hit(args.Key, 1)
+	n.dataLock.Lock()
+	*reply = n.data[args.Key]
+	n.dataLock.Unlock()
+	return nil
+}
+
+// Expire exported
+func (n *Node) Expire(args ExpireArgs, reply *bool) error {
+	op := PermWrite
+	if args.TTL <= 0 {
+		op = PermDelete
+	}
+	if n.allowNode(args.Auth, "expire", args.Key) != nil {
+		// only ring nodes moving the ACL around may give it a deadline
+		if args.Key == aclKey {
+			return errors.New("acl: the access control list can't expire")
+		}
+		err := n.allow(args.Cred, op, args.Key, args.TTL.String())
+		if err != nil {
+			return err
+		}
+	}
+	if args.TTL <= 0 {
+		n.remove(args.Key, reply)
+		return nil
+	}
+	n.dataLock.Lock()
+	defer n.dataLock.Unlock()
+	if _, ok := n.data[args.Key]; !ok {
+		return nil
+	}
+	*reply = true
+	n.expiry[args.Key] = time.Now().Add(args.TTL)
 	return nil
 }
 
+// expire drops key if its deadline has passed
+func (n *Node) expire(key string) {
+	n.dataLock.Lock()
+	expired := n.expireLocked(key)
+	n.dataLock.Unlock()
+	if expired {
+		n.invalidate(key)
+		n.publish(EventDelete, key, "")
+	}
+}
+
+// expireLocked is expire for callers that hold dataLock, reporting whether
+// key was dropped so that they can invalidate and publish once they let go
+func (n *Node) expireLocked(key string) bool {
+	deadline, ok := n.expiry[key]
+	if !ok || time.Now().Before(deadline) {
+		return false
+	}
+	return n.deleteLocked(key)
+}
+
+// ttl is what is left of key's time to live; callers hold dataLock
+func (n *Node) ttl(key string) time.Duration {
+	if deadline, ok := n.expiry[key]; ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
 // Delete exported
-func (n *Node) Delete(key string, reply *bool) error {
-	if _, ok := n.data[key]; ok {
-		*reply = true
-		delete(n.data, key)
-		n.bufferWriter.WriteString("1 " + key + " ")
+func (n *Node) Delete(args KeyArgs, reply *bool) error {
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
 	}
+	err = n.allow(args.Cred, PermDelete, args.Key, "")
+	if err != nil {
+		return err
+	}
+	n.remove(args.Key, reply)
 	return nil
 }
 
+func (n *Node) remove(key string, reply *bool) {
+	n.expire(key)
+	n.delete(key, reply)
+	if *reply {
+		n.publish(EventDelete, key, "")
+	}
+}
+
+func (n *Node) delete(key string, reply *bool) {
+	n.dataLock.Lock()
+	deleted := n.deleteLocked(key)
+	n.dataLock.Unlock()
+	if deleted {
+		*reply = true
+		n.invalidate(key)
+	}
+}
+
+// deleteLocked drops key and logs it to the backup; callers hold dataLock
+// and invalidate the key's replicas once they let go of it
+func (n *Node) deleteLocked(key string) bool {
+	if _, ok := n.data[key]; !ok {
+		return false
+	}
+	delete(n.data, key)
+	delete(n.expiry, key)
+	delete(n.flags, key)
+	delete(n.version, key)
+	n.bufferWriter.WriteString("1 " + key + " ")
+	return true
+}
+
 // Ping exported
 func (n *Node) Ping(none bool, reply *bool) error {
 	return nil
 }
 
 // MigrateWhenJoining exported
-func (n *Node) MigrateWhenJoining(addr string, reply *bool) error {
-	client := dial(addr)
-	if client == nil {
-		Green.Println(addr)
-		return errors.New("Migrate when joining: client offline")
+func (n *Node) MigrateWhenJoining(args Address, reply *bool) error {
+	addr := args.Addr
+	if !n.verify(args.Auth, addr, "join", addr) {
+		n.auth.reject("join")
+		Yellow.Println(TimeClock(), "join: reject unauthenticated", addr, "at", n.IP)
+		return errors.New("Migrate when joining: unauthenticated")
+	}
+	if !n.trusted(addr, "join") {
+		return errors.New("Migrate when joining: unverified node ID")
+	}
+	n.ids.forget(addr)
+	start := n.idOf(addr)
+	err := n.transfer(addr, func(id *big.Int) bool {
+		return !between(start, id, n.id, true)
+	})
+	if err != nil {
+		return err
 	}
-	defer client.Close()
-	for k, v := range n.data {
-		if between(hashString(k), hashString(addr), hashString(n.IP), true) {
-			n.Delete(k, reply)
-			putArgs := PutArgs {
-				Key: k,
-				Val: v,
-			}
-			err := client.Call("Node.Put", putArgs, reply)
-			if err != nil {
-				return err
-			}
-			Magenta.Printf("%v Migrate (%v, %v) to %v\n", TimeClock(), k, v, addr)
-		}
+	// the keys are gone, so don't wait for addr to notify before
+	// redirecting to it
+	if n.predecessor == "" || between(n.idOf(n.predecessor), start, n.id, false) {
+		n.predecessor = addr
+		n.cache.learn(n, addr, n.IP)
+		n.neighbourChanged()
 	}
-	return nil
+	n.handOffLeases(addr, false)
+	err = n.handOffTopics(addr, false)
+	if err != nil {
+		return err
+	}
+	return n.handOffWatches(addr, false)
 }
 
 func (n *Node) migrateWhenQuiting(addr string) error {
-	client := dial(addr)
-	if client == nil {
-		return errors.New("Migrate when quiting: client offline")
+	err := n.transfer(addr, func(id *big.Int) bool {
+		return true
+	})
+	if err != nil {
+		return err
 	}
-	defer client.Close()
-	var reply bool
-	for k, v := range n.data {
-		n.Delete(k, &reply)
-		putArgs := PutArgs {
-			Key: k, 
-			Val: v,
-		}
-		err := client.Call("Node.Put", putArgs, &reply)
-		if err != nil {
-			return err
-		}
-		Magenta.Printf("%v Migrate (%v, %v) to %v\n", TimeClock(), k, v, addr)
+	n.handOffLeases(addr, true)
+	err = n.handOffTopics(addr, true)
+	if err != nil {
+		return err
 	}
-	return nil
+	return n.handOffWatches(addr, true)
 }
 
 // PassSuccessor exported
@@ -331,11 +680,11 @@ func (n *Node) PassSuccessor(nth int, successor *string) error {
 	return nil
 }
 
-func rpcGetPredecessor(addr string) (string, error) {
+func (n *Node) rpcGetPredecessor(addr string) (string, error) {
 	if addr == "" {
 		return "", errors.New("get predecessor: lack valid address")
 	}
-	client := dial(addr)
+	client := n.dial(addr)
 	if client == nil {
 		return "", errors.New("get predecessor: client offline")
 	}
@@ -351,116 +700,229 @@ func rpcGetPredecessor(addr string) (string, error) {
 	return reply, nil
 }
 
-func rpcNotify(addr, predecessor string) error {
+func (n *Node) rpcNotify(addr, predecessor string) error {
 	if addr == "" {
 		return errors.New("notify: lack valid address")
 	}
-	client := dial(addr)
+	client := n.dial(addr)
 	if client == nil {
 		return errors.New("notify: client offline")
 	}
 	defer client.Close()
 	var reply bool
-	return client.Call("Node.Notify", predecessor, &reply)
+	return client.Call("Node.Notify", Address{Addr: predecessor, Auth: n.sign("notify", predecessor)}, &reply)
 }
 
-func rpcFindSuccessor(addr string, id *big.Int) (string, error) {
+func (n *Node) rpcFindSuccessor(addr string, id *big.Int) (string, error) {
 	if addr == "" {
 		return "", errors.New("find successor: lack valid address")
 	}
-	client := dial(addr)
+	client := n.dial(addr)
 	if client == nil {
 		return "", errors.New("find successor: client offline")
 	}
 	defer client.Close()
-	var reply string
+	var reply Address
 	err := client.Call("Node.FindSuccessor", id, &reply)
-	return reply, err
+	if err != nil {
+		return "", err
+	}
+	if !n.verify(reply.Auth, "", "find", id.Text(16), reply.Addr) {
+		n.auth.reject("find")
+		Yellow.Println(TimeClock(), "find successor: reject unauthenticated answer", reply.Addr, "from", addr)
+		return "", errors.New("find successor: unauthenticated answer")
+	}
+	if !n.trusted(reply.Addr, "find successor") {
+		return "", errors.New("find successor: unverified node ID")
+	}
+	return reply.Addr, nil
 }
 
-func rpcMigrateWhenJoining(addr, predecessor string) error {
+func (n *Node) rpcMigrateWhenJoining(addr, predecessor string) error {
 	if addr == "" {
 		return errors.New("Migrate when joining: lack valid address")
 	}
-	client := dial(addr)
+	client := n.dial(addr)
 	if client == nil {
 		return errors.New("Migrate when joining: client offline")
 	}
 	defer client.Close()
 	var reply bool
-	err := client.Call("Node.MigrateWhenJoining", predecessor, &reply)
+	err := client.Call("Node.MigrateWhenJoining", Address{Addr: predecessor, Auth: n.sign("join", predecessor)}, &reply)
 	return err
 }
 
-func (n *Node) find(key string) string {
-	client := dial(n.IP)
+func (n *Node) rpcPut(addr string, args PutArgs) error {
+	if addr == "" {
+		return errors.New("put: lack valid address")
+	}
+	var reply bool
+	args.Cred = n.credential(PermWrite, args.Key, args.Val)
+	_, err := n.callAt(addr, args.Key, "Put", args, &reply)
+	return err
+}
+
+func (n *Node) rpcGet(addr, key string) (string, error) {
+	if addr == "" {
+		return "", errors.New("get: lack valid address")
+	}
+	var reply string
+	_, err := n.callAt(addr, key, "Get", KeyArgs{Key: key, Cred: n.credential(PermRead, key, "")}, &reply)
+	return reply, err
+}
+
+func (n *Node) rpcExpire(addr string, args ExpireArgs) (bool, error) {
+	if addr == "" {
+		return false, errors.New("expire: lack valid address")
+	}
+	client := n.dial(addr)
 	if client == nil {
-		panic(errors.New("Dial localhost failed"))
+		return false, errors.New("expire: client offline")
 	}
 	defer client.Close()
-	var reply string
-	err := client.Call("Node.FindSuccessor", hashString(key), &reply)
+	var reply bool
+	op := PermWrite
+	if args.TTL <= 0 {
+		op = PermDelete
+	}
+	args.Cred = n.credential(op, args.Key, args.TTL.String())
+	err := client.Call("Node.Expire", args, &reply)
+	return reply, err
+}
+
+func (n *Node) rpcDelete(addr, key string) (bool, error) {
+	if addr == "" {
+		return false, errors.New("delete: lack valid address")
+	}
+	var reply bool
+	_, err := n.callAt(addr, key, "Delete", KeyArgs{Key: key, Cred: n.credential(PermDelete, key, "")}, &reply)
+	return reply, err
+}
+
+func (n *Node) find(key string) string {
+	addr, err := n.lookup(key)
 	if err != nil {
 		Yellow.Println(TimeClock(), err)
 	}
-	return reply
+	return addr
+}
+
+// lookup is find that reports why no owner was found; in secure mode the
+// owner must be agreed on by several paths
+func (n *Node) lookup(key string) (string, error) {
+	if n.secure > 0 {
+		return n.secureLookup(key)
+	}
+	client := n.dial(n.IP)
+	if client == nil {
+		if !n.listening {
+			return "", ErrStopping
+		}
+		panic(errors.New("Dial localhost failed"))
+	}
+	defer client.Close()
+	var reply Address
+	err := client.Call("Node.FindSuccessor", hashString(key), &reply)
+	return reply.Addr, err
 }
 
 type rpcServer struct {
 	node      *Node
 	server    *rpc.Server
+	grpc      *grpcServer
 	listener  net.Listener
+	accepted  chan struct{}
+	lock      sync.Mutex
+	conns     map[net.Conn]bool
+	routes    sync.WaitGroup
 }
 
 func newrpcServer(n *Node) *rpcServer {
 	return &rpcServer{
 		node: n,
+		accepted: make(chan struct{}),
+		conns: make(map[net.Conn]bool),
 	}
 }
 
 func (s *rpcServer) listen() error {
 	s.server = rpc.NewServer()
 	s.server.Register(s.node)
-	l, e := net.Listen("tcp", s.node.IP)
+	l, e := s.node.listen(s.node.IP)
 	if e != nil {
 		return e
 	}
-	s.node.create()
 	s.listener = l
 	s.node.listening = true
-	go s.server.Accept(l)
+	s.node.create()
+	s.grpc = newgrpcServer(s.node, s.server, l.Addr())
+	go s.accept()
 	return nil
 }
 
-func (s *rpcServer) quit() {
-	s.node.file.Close()
-	file, err := os.OpenFile("./backup/" + s.node.IP + ".txt", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
-	if err != nil {
-		panic(err)
+// accept serves net/rpc and gRPC on the same port, telling them apart by
+// the HTTP/2 client preface that every gRPC connection starts with
+func (s *rpcServer) accept() {
+	defer close(s.accepted)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.routes.Add(1)
+		go func() {
+			defer s.routes.Done()
+			s.route(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+func (s *rpcServer) route(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			Cyan.Println(TimeClock(), "tls: reject", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	r := bufio.NewReader(conn)
+	for i := 1; i <= len(http2Preface); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if b[i - 1] != http2Preface[i - 1] {
+			s.server.ServeCodec(newlimitCodec(&peekedConn{conn, r}, s.node))
+			return
+		}
+	}
+	s.grpc.serve(&peekedConn{conn, r})
+}
+
+func (s *rpcServer) quit(ctx context.Context) error {
+	err := s.shutdown(ctx)
+	file, e := os.OpenFile("./backup/" + s.node.IP + ".txt", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
+	if e != nil {
+		panic(e)
 	}
 	file.Close()
-	s.node.listening = false
-	s.listener.Close()
+	return err
 }
 
 // debug backup function
 // in real circumstance, these won't be executed
 func (s *rpcServer) forceQuit() {
-	s.node.file.Close()
-	s.node.listening = false
-	s.listener.Close()
-}
-
-func (s *rpcServer) join(addr string) error {
-	err := s.listen()
-	if err != nil {
-		return err
-	}
-	err = s.node.join(addr)
-	if err != nil {
-		return err
-	}
-	return nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.shutdown(ctx)
 }
 
 func (s *rpcServer) dump() {
@@ -468,5 +930,12 @@ func (s *rpcServer) dump() {
 	Red.Println(TimeClock(), "ID:", s.node.id)
 	Red.Println(TimeClock(), "Successor:", s.node.successor)
 	Red.Println(TimeClock(), "Predecessor:", s.node.predecessor)
+	Red.Println(TimeClock(), "Rejected:", s.node.auth.snapshot())
+	Red.Println(TimeClock(), "Transfers:", s.node.transfers.snapshot())
+	Red.Println(TimeClock(), "Hot:", s.node.heat.snapshot())
+	Red.Println(TimeClock(), "Load:", s.node.load())
+	Red.Println(TimeClock(), "Periods:", s.node.upkeep.stabilize.snapshot(), s.node.upkeep.checkPredecessor.snapshot(), s.node.upkeep.fixFingers.snapshot())
+	s.node.dataLock.Lock()
 	Red.Println(TimeClock(), "Data:", s.node.data)
+	s.node.dataLock.Unlock()
 }
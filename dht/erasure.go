@@ -0,0 +1,558 @@
+package dht
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reed-Solomon over GF(2^8), with a systematic Cauchy matrix so that the
+// first Need fragments are the data itself and any Need fragments rebuild it
+
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x & 0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i - 255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a] + gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255 - gfLog[a]]
+}
+
+// codingRow is row i of the encoding matrix for need data fragments
+func codingRow(i, need int) []byte {
+	row := make([]byte, need)
+	if i < need {
+		row[i] = 1
+		return row
+	}
+	for j := 0; j < need; j++ {
+		row[j] = gfInv(byte(i) ^ byte(j))
+	}
+	return row
+}
+
+// invert returns the inverse of the square matrix m over GF(2^8)
+func invert(m [][]byte) ([][]byte, error) {
+	size := len(m)
+	work := make([][]byte, size)
+	for i := range m {
+		work[i] = make([]byte, 2 * size)
+		copy(work[i], m[i])
+		work[i][size + i] = 1
+	}
+	for col := 0; col < size; col++ {
+		pivot := -1
+		for row := col; row < size; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for k := range work[col] {
+			work[col][k] = gfMul(work[col][k], scale)
+		}
+		for row := 0; row < size; row++ {
+			if row != col && work[row][col] != 0 {
+				factor := work[row][col]
+				for k := range work[row] {
+					work[row][k] ^= gfMul(factor, work[col][k])
+				}
+			}
+		}
+	}
+	inverse := make([][]byte, size)
+	for i := range work {
+		inverse[i] = work[i][size:]
+	}
+	return inverse, nil
+}
+
+func combine(row []byte, shards [][]byte) []byte {
+	out := make([]byte, len(shards[0]))
+	for j, c := range row {
+		if c == 0 {
+			continue
+		}
+		for k, b := range shards[j] {
+			out[k] ^= gfMul(c, b)
+		}
+	}
+	return out
+}
+
+// splitShards pads data and cuts it into need equal data shards
+func splitShards(data []byte, need int) [][]byte {
+	size := (len(data) + need - 1) / need
+	if size == 0 {
+		size = 1
+	}
+	padded := make([]byte, size * need)
+	copy(padded, data)
+	shards := make([][]byte, need)
+	for i := range shards {
+		shards[i] = padded[i * size : (i + 1) * size]
+	}
+	return shards
+}
+
+// encodeFragment computes fragment index from the data shards
+func encodeFragment(shards [][]byte, index int) []byte {
+	return combine(codingRow(index, len(shards)), shards)
+}
+
+// decodeShards recovers the data shards from need fragments
+func decodeShards(frags []Fragment, need int) ([][]byte, error) {
+	if len(frags) < need {
+		return nil, errors.New("erasure: need " + strconv.Itoa(need) + " fragments, have " + strconv.Itoa(len(frags)))
+	}
+	frags = frags[:need]
+	matrix := make([][]byte, need)
+	shards := make([][]byte, need)
+	for i, f := range frags {
+		matrix[i] = codingRow(f.Index, need)
+		shards[i] = f.Data
+	}
+	inverse, err := invert(matrix)
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, need)
+	for i := range data {
+		data[i] = combine(inverse[i], shards)
+	}
+	return data, nil
+}
+
+// Fragment exported
+// fragment Index of the Total a value was coded into, any Need of which
+// rebuild its Size bytes; Version tells a rewrite from stale fragments
+type Fragment struct {
+	Key string
+	Index, Need, Total int
+	Size int
+	Version uint64
+	Data []byte
+	Cred Cred
+	Auth Auth
+}
+
+// FragmentQuery exported
+// asks for the fragment held of Key, without its data unless Data is set
+type FragmentQuery struct {
+	Key string
+	Data bool
+	From string
+	Cred Cred
+	Auth Auth
+}
+
+type fragmentStore struct {
+	lock sync.Mutex
+	frags map[string]Fragment
+}
+
+// StoreFragment exported
+func (n *Node) StoreFragment(args Fragment, reply *bool) error {
+	if n.allowNode(args.Auth, "fragment", args.Key) != nil {
+		err := n.allow(args.Cred, PermWrite, args.Key, string(args.Data))
+		if err != nil {
+			return err
+		}
+	}
+	args.Cred, args.Auth = Cred{}, Auth{}
+	n.fragments.lock.Lock()
+	defer n.fragments.lock.Unlock()
+	if old, ok := n.fragments.frags[args.Key]; ok && old.Version > args.Version {
+		return nil
+	}
+	n.fragments.frags[args.Key] = args
+	*reply = true
+	return nil
+}
+
+// Fragment exported
+// Index is -1 when no fragment of the key is held
+func (n *Node) Fragment(args FragmentQuery, reply *Fragment) error {
+	if n.allowNode(args.Auth, "fragment", args.Key) != nil {
+		err := n.allow(args.Cred, PermRead, args.Key, "")
+		if err != nil {
+			return err
+		}
+	}
+	n.fragments.lock.Lock()
+	f, ok := n.fragments.frags[args.Key]
+	n.fragments.lock.Unlock()
+	if !ok {
+		*reply = Fragment{Key: args.Key, Index: -1}
+		return nil
+	}
+	if !args.Data {
+		f.Data = nil
+	}
+	*reply = f
+	return nil
+}
+
+// RepairFragments exported
+// asks the owner of a key to restore its missing fragments
+func (n *Node) RepairFragments(args FragmentQuery, reply *bool) error {
+	err := n.allowNode(args.Auth, "fragment", args.Key)
+	if err != nil {
+		return err
+	}
+	n.spawn(func() {
+		n.repair(args.Key, args.From)
+	})
+	*reply = true
+	return nil
+}
+
+func (n *Node) rpcFragment(addr, key string, data bool) (Fragment, error) {
+	var reply Fragment
+	client := n.dial(addr)
+	if client == nil {
+		return reply, errors.New("fragment: client offline")
+	}
+	defer client.Close()
+	err := client.Call("Node.Fragment", FragmentQuery{Key: key, Data: data, Auth: n.sign("fragment", key), Cred: n.credential(PermRead, key, "")}, &reply)
+	return reply, err
+}
+
+func (n *Node) rpcStoreFragment(addr string, f Fragment) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("fragment: client offline")
+	}
+	defer client.Close()
+	f.Auth = n.sign("fragment", f.Key)
+	f.Cred = n.credential(PermWrite, f.Key, string(f.Data))
+	var reply bool
+	return client.Call("Node.StoreFragment", f, &reply)
+}
+
+// placement lists the owner of key and its successors, total nodes at most,
+// fragment i belonging on the i-th
+func (n *Node) placement(key string, total int) ([]string, error) {
+	owner, err := n.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return nil, errors.New("erasure: no owner for " + key)
+	}
+	nodes := []string{owner}
+	cur := owner
+	for len(nodes) < total {
+		client := n.dial(cur)
+		if client == nil {
+			break
+		}
+		var suc string
+		err := client.Call("Node.PassSuccessor", 0, &suc)
+		client.Close()
+		if err != nil || suc == "" || suc == owner {
+			break
+		}
+		nodes = append(nodes, suc)
+		cur = suc
+	}
+	return nodes, nil
+}
+
+// putErasure codes val into total fragments on consecutive nodes
+func (n *Node) putErasure(key string, val []byte, need, total int) error {
+	if need < 1 || total < need || total > 255 {
+		return errors.New("erasure: expect 1 <= m <= n <= 255")
+	}
+	nodes, err := n.placement(key, total)
+	if err != nil {
+		return err
+	}
+	if len(nodes) < total {
+		return errors.New("erasure: ring has " + strconv.Itoa(len(nodes)) + " nodes, need " + strconv.Itoa(total))
+	}
+	shards := splitShards(val, need)
+	version := uint64(time.Now().UnixNano())
+	for i, addr := range nodes {
+		err = n.rpcStoreFragment(addr, Fragment {
+			Key: key,
+			Index: i,
+			Need: need,
+			Total: total,
+			Size: len(val),
+			Version: version,
+			Data: encodeFragment(shards, i),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gather collects need fragments of the newest version from nodes
+func (n *Node) gather(key string, nodes []string) ([]Fragment, error) {
+	var frags []Fragment
+	var newest uint64
+	for _, addr := range nodes {
+		f, err := n.rpcFragment(addr, key, true)
+		if err != nil || f.Index < 0 {
+			continue
+		}
+		if f.Version > newest {
+			newest = f.Version
+			kept := frags[:0]
+			for _, g := range frags {
+				if g.Version == newest {
+					kept = append(kept, g)
+				}
+			}
+			frags = kept
+		}
+		if f.Version == newest {
+			frags = append(frags, f)
+			if len(frags) == f.Need {
+				break
+			}
+		}
+	}
+	if len(frags) == 0 {
+		return nil, errors.New("erasure: match not found")
+	}
+	if len(frags) < frags[0].Need {
+		return nil, errors.New("erasure: " + key + " has " + strconv.Itoa(len(frags)) + " of " + strconv.Itoa(frags[0].Need) + " fragments needed")
+	}
+	return frags, nil
+}
+
+// fragmentTotal reads how many fragments key was coded into off the first
+// fragment found at from, the owner or the successors a repair would move
+// fragments back from, rather than walking the ring for all of them
+func (n *Node) fragmentTotal(key, from string) (int, error) {
+	if from != "" {
+		f, err := n.rpcFragment(from, key, false)
+		if err == nil && f.Index >= 0 {
+			return f.Total, nil
+		}
+	}
+	nodes, err := n.placement(key, 1)
+	if err != nil {
+		return 0, err
+	}
+	cur := nodes[0]
+	for i := 0; i <= len(n.successor); i++ {
+		f, err := n.rpcFragment(cur, key, false)
+		if err == nil && f.Index >= 0 {
+			return f.Total, nil
+		}
+		client := n.dial(cur)
+		if client == nil {
+			break
+		}
+		var suc string
+		err = client.Call("Node.PassSuccessor", 0, &suc)
+		client.Close()
+		if err != nil || suc == "" || suc == nodes[0] {
+			break
+		}
+		cur = suc
+	}
+	return 0, errors.New("erasure: match not found")
+}
+
+// getErasure rebuilds the value of key from any m of its fragments
+func (n *Node) getErasure(key string) ([]byte, error) {
+	total, err := n.fragmentTotal(key, "")
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := n.placement(key, total)
+	if err != nil {
+		return nil, err
+	}
+	frags, err := n.gather(key, nodes)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := decodeShards(frags, frags[0].Need)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 0, len(shards) * len(shards[0]))
+	for _, shard := range shards {
+		val = append(val, shard...)
+	}
+	return val[:frags[0].Size], nil
+}
+
+// repair runs at the owner of key: it rebuilds the fragments its placement
+// is missing and hands them to the nodes holding none
+func (n *Node) repair(key, from string) {
+	n.fragments.lock.Lock()
+	own, ok := n.fragments.frags[key]
+	n.fragments.lock.Unlock()
+	var err error
+	total := own.Total
+	if !ok {
+		total, err = n.fragmentTotal(key, from)
+		if err != nil {
+			return
+		}
+	}
+	nodes, err := n.placement(key, total)
+	if err != nil || nodes[0] != n.IP {
+		return
+	}
+	metas := make([]Fragment, len(nodes))
+	var newest Fragment
+	for i, addr := range nodes {
+		metas[i], err = n.rpcFragment(addr, key, false)
+		if err != nil {
+			metas[i].Index = -1
+		}
+		if metas[i].Version > newest.Version {
+			newest = metas[i]
+		}
+	}
+	if newest.Version == 0 && from != "" {
+		newest, err = n.rpcFragment(from, key, false)
+		if err != nil || newest.Index < 0 {
+			return
+		}
+	}
+	if newest.Version == 0 {
+		return
+	}
+	if len(nodes) > newest.Total {
+		nodes = nodes[:newest.Total]
+	}
+	present := make(map[int]bool)
+	var free []string
+	for i, addr := range nodes {
+		if metas[i].Index >= 0 && metas[i].Version == newest.Version {
+			present[metas[i].Index] = true
+		} else {
+			free = append(free, addr)
+		}
+	}
+	var missing []int
+	for i := 0; i < newest.Total; i++ {
+		if !present[i] {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 || len(free) == 0 {
+		return
+	}
+	sources := nodes
+	if from != "" {
+		sources = append(append([]string(nil), nodes...), from)
+	}
+	frags, err := n.gather(key, sources)
+	if err != nil {
+		Yellow.Println(TimeClock(), "erasure: can't rebuild", key, err)
+		return
+	}
+	shards, err := decodeShards(frags, newest.Need)
+	if err != nil {
+		Yellow.Println(TimeClock(), "erasure: can't rebuild", key, err)
+		return
+	}
+	for i, addr := range free {
+		if i >= len(missing) {
+			break
+		}
+		f := frags[0]
+		f.Index = missing[i]
+		f.Data = encodeFragment(shards, missing[i])
+		err = n.rpcStoreFragment(addr, f)
+		if err == nil {
+			Magenta.Printf("%v Rebuilt fragment %v of %v at %v\n", TimeClock(), f.Index, key, addr)
+		}
+	}
+}
+
+// repairFragmentsPeriodically keeps every fragment n holds where the
+// successor list says it belongs: owners rebuild what is missing, other
+// holders wake the owner up when it has none, and holders that fell out of
+// the placement drop theirs once the placement is complete again
+func (n *Node) repairFragmentsPeriodically() {
+	period := time.NewTicker(5 * time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		n.fragments.lock.Lock()
+		var held []Fragment
+		for _, f := range n.fragments.frags {
+			held = append(held, f)
+		}
+		n.fragments.lock.Unlock()
+		for _, f := range held {
+			nodes, err := n.placement(f.Key, f.Total)
+			if err != nil {
+				continue
+			}
+			pos := -1
+			for i, addr := range nodes {
+				if addr == n.IP {
+					pos = i
+				}
+			}
+			if pos == 0 {
+				n.repair(f.Key, "")
+				continue
+			}
+			complete := len(nodes) >= f.Total
+			ownerHas := false
+			for i, addr := range nodes {
+				meta, err := n.rpcFragment(addr, f.Key, false)
+				if err != nil || meta.Index < 0 || meta.Version < f.Version {
+					complete = false
+				} else if i == 0 {
+					ownerHas = true
+				}
+			}
+			if pos < 0 && complete {
+				n.fragments.lock.Lock()
+				delete(n.fragments.frags, f.Key)
+				n.fragments.lock.Unlock()
+				Magenta.Printf("%v Dropped fragment %v of %v\n", TimeClock(), f.Index, f.Key)
+				continue
+			}
+			if !ownerHas || pos < 0 {
+				client := n.dial(nodes[0])
+				if client == nil {
+					continue
+				}
+				var reply bool
+				client.Call("Node.RepairFragments", FragmentQuery{Key: f.Key, From: n.IP, Auth: n.sign("fragment", f.Key)}, &reply)
+				client.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// dirPrefix starts the key of every directory, followed by its path
+	dirPrefix = "fs:"
+	// dirMagic starts the value of a directory
+	dirMagic = "dir:"
+)
+
+// FileEntry exported
+// one name in a directory; files list their content-addressed chunks and
+// the SHA-256 of the whole content, checked on read
+type FileEntry struct {
+	Dir bool
+	Size int64
+	Sum string
+	Chunks []string
+	Mod int64
+}
+
+// Directory exported
+type Directory struct {
+	Entries map[string]FileEntry
+}
+
+func parseDirectory(val string) (*Directory, bool) {
+	if !strings.HasPrefix(val, dirMagic) {
+		return nil, false
+	}
+	var d Directory
+	err := json.Unmarshal([]byte(val[len(dirMagic):]), &d)
+	if err != nil {
+		return nil, false
+	}
+	if d.Entries == nil {
+		d.Entries = make(map[string]FileEntry)
+	}
+	return &d, true
+}
+
+// referencedChunks lists the chunks a stored value keeps alive
+func referencedChunks(val string) []string {
+	if m, ok := parseManifest(val); ok {
+		return m.Chunks
+	}
+	var chunks []string
+	if d, ok := parseDirectory(val); ok {
+		for _, e := range d.Entries {
+			chunks = append(chunks, e.Chunks...)
+		}
+	}
+	return chunks
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// readDir fetches the directory at dir with the version it was read at;
+// a missing directory reads as empty with version 0
+func (n *Node) readDir(dir string) (*Directory, uint64, error) {
+	key := dirPrefix + dir
+	item, err := n.lookupItem(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if item.Version == 0 {
+		return &Directory{Entries: make(map[string]FileEntry)}, 0, nil
+	}
+	d, ok := parseDirectory(item.Val)
+	if !ok {
+		return nil, 0, errors.New("fs: " + dir + " is corrupt")
+	}
+	return d, item.Version, nil
+}
+
+// updateDir applies change to the directory at dir, retrying when another
+// writer got there first; change returning an error aborts
+func (n *Node) updateDir(dir string, change func(d *Directory) error) error {
+	key := dirPrefix + dir
+	for i := 0; i < 16; i++ {
+		d, version, err := n.readDir(dir)
+		if err != nil {
+			return err
+		}
+		err = change(d)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		args := StoreArgs{Op: StoreCas, Item: Item{Key: key, Val: dirMagic + string(b), Version: version}}
+		if version == 0 {
+			args.Op = StoreAdd
+		}
+		reply, err := n.storeItem(args)
+		if err != nil {
+			return err
+		}
+		if reply.Status == "STORED" {
+			return nil
+		}
+		time.Sleep(time.Duration(i + 1) * 10 * time.Millisecond)
+	}
+	return errors.New("fs: " + dir + " is too busy")
+}
+
+// link sets name in its parent directory to e, creating missing parents
+func (n *Node) link(name string, e FileEntry) error {
+	dir, base := path.Split(name)
+	dir = cleanPath(dir)
+	if dir != "/" {
+		d, _, err := n.readDir(path.Dir(dir))
+		if err != nil {
+			return err
+		}
+		if parent, ok := d.Entries[path.Base(dir)]; !ok {
+			err = n.link(dir, FileEntry{Dir: true, Mod: time.Now().Unix()})
+			if err != nil {
+				return err
+			}
+		} else if !parent.Dir {
+			return errors.New("fs: " + dir + " is a file")
+		}
+	}
+	return n.updateDir(dir, func(d *Directory) error {
+		if old, ok := d.Entries[base]; ok && old.Dir != e.Dir {
+			return errors.New("fs: " + name + " exists")
+		}
+		if old, ok := d.Entries[base]; ok && e.Dir {
+			e = old
+		}
+		d.Entries[base] = e
+		return nil
+	})
+}
+
+// stat returns the entry for name
+func (n *Node) stat(name string) (FileEntry, error) {
+	if name == "/" {
+		return FileEntry{Dir: true}, nil
+	}
+	d, _, err := n.readDir(path.Dir(name))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	e, ok := d.Entries[path.Base(name)]
+	if !ok {
+		return FileEntry{}, errors.New("fs: " + name + " not found")
+	}
+	return e, nil
+}
+
+// putFile stores r as the file name, replacing any earlier version
+func (n *Node) putFile(name string, r io.Reader) (FileEntry, error) {
+	name = cleanPath(name)
+	if name == "/" {
+		return FileEntry{}, errors.New("fs: / is a directory")
+	}
+	sum := sha256.New()
+	m, err := n.putChunks(io.TeeReader(r, sum))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	e := FileEntry {
+		Size: m.Size,
+		Sum: hex.EncodeToString(sum.Sum(nil)),
+		Chunks: m.Chunks,
+		Mod: time.Now().Unix(),
+	}
+	return e, n.link(name, e)
+}
+
+// getFile writes the file name to w, failing if its content doesn't match
+// the checksum recorded when it was stored
+func (n *Node) getFile(name string, w io.Writer) (FileEntry, error) {
+	name = cleanPath(name)
+	e, err := n.stat(name)
+	if err != nil {
+		return e, err
+	}
+	if e.Dir {
+		return e, errors.New("fs: " + name + " is a directory")
+	}
+	sum := sha256.New()
+	err = n.readChunks(&Manifest{Size: e.Size, Chunks: e.Chunks}, io.MultiWriter(w, sum))
+	if err != nil {
+		return e, err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != e.Sum {
+		return e, errors.New("fs: " + name + " failed its integrity check")
+	}
+	return e, nil
+}
+
+// listDir returns the names under dir, directories with a trailing slash
+func (n *Node) listDir(dir string) ([]string, map[string]FileEntry, error) {
+	dir = cleanPath(dir)
+	e, err := n.stat(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !e.Dir {
+		return []string{path.Base(dir)}, map[string]FileEntry{path.Base(dir): e}, nil
+	}
+	d, _, err := n.readDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{}
+	for name, e := range d.Entries {
+		if e.Dir {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, d.Entries, nil
+}
+
+// removeFile unlinks name; directories must be empty. Chunks are left to
+// expire once no directory renews them
+func (n *Node) removeFile(name string) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return errors.New("fs: can't remove /")
+	}
+	e, err := n.stat(name)
+	if err != nil {
+		return err
+	}
+	if e.Dir {
+		d, _, err := n.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(d.Entries) > 0 {
+			return errors.New("fs: " + name + " is not empty")
+		}
+	}
+	err = n.updateDir(path.Dir(name), func(d *Directory) error {
+		if _, ok := d.Entries[path.Base(name)]; !ok {
+			return errors.New("fs: " + name + " not found")
+		}
+		delete(d.Entries, path.Base(name))
+		return nil
+	})
+	if err != nil || !e.Dir {
+		return err
+	}
+	key := dirPrefix + name
+	addr, err := n.lookup(key)
+	if err != nil {
+		return err
+	}
+	_, err = n.rpcDelete(addr, key)
+	return err
+}
+
+// LsCmd exported
+func (c *Chord) LsCmd(args ...string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	names, entries, err := c.Node.listDir(dir)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v %v: %v entries\n", TimeClock(), cleanPath(dir), len(names))
+	for _, name := range names {
+		e := entries[strings.TrimSuffix(name, "/")]
+		Magenta.Printf("  %-32v %10v  %v\n", name, e.Size, time.Unix(e.Mod, 0).Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// PutFileCmd exported
+// put-file <local-file> <path>
+func (c *Chord) PutFileCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Put file: expect local file and path")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	e, err := c.Node.putFile(args[1], file)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Put file %v, %v bytes in %v chunks\n", TimeClock(), cleanPath(args[1]), e.Size, len(e.Chunks))
+	return nil
+}
+
+// GetFileCmd exported
+// get-file <path> <local-file>; the local file is only replaced once the
+// content passed its integrity check
+func (c *Chord) GetFileCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Get file: expect path and local file")
+	}
+	tmp := args[1] + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	e, err := c.Node.getFile(args[0], file)
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, args[1])
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Get file %v, %v bytes to %v\n", TimeClock(), cleanPath(args[0]), e.Size, args[1])
+	return nil
+}
+
+// RmCmd exported
+func (c *Chord) RmCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Rm: expect path")
+	}
+	err := c.Node.removeFile(args[0])
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Removed %v\n", TimeClock(), cleanPath(args[0]))
+	return nil
+}
@@ -0,0 +1,896 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"math/big"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protocolVersion is the version of node.proto spoken by this node
+const protocolVersion = 1
+
+const grpcService = "dht.v1.Node"
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// wireMessage is a node.proto message encoded by hand with protowire
+type wireMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+type pbEmpty struct{}
+
+type pbAddress struct {
+	Address string
+	Auth Auth
+}
+
+type pbAck struct {
+	OK bool
+}
+
+type pbFindSuccessorRequest struct {
+	ID []byte
+}
+
+type pbPassSuccessorRequest struct {
+	Index int32
+}
+
+type pbPingReply struct {
+	Version uint32
+}
+
+type pbPutRequest struct {
+	Key, Value string
+	Flags uint32
+	Version uint64
+	Cred Cred
+	Auth Auth
+}
+
+type pbMigrateBatchRequest struct {
+	Transfer string
+	Seq int32
+	Items []MigrateItem
+	Auth Auth
+}
+
+type pbMigrateBatchReply struct {
+	Seq int32
+}
+
+type pbKey struct {
+	Key string
+	Cred Cred
+}
+
+type pbValue struct {
+	Value string
+}
+
+type pbInvokeRequest struct {
+	Method string
+	Args []byte
+}
+
+type pbInvokeReply struct {
+	Reply []byte
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// walkFields calls f on every field of b, with v set for varints and raw
+// set for length-delimited fields; fields of other types are skipped
+func walkFields(b []byte, f func(num protowire.Number, v uint64, raw []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, v, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			raw, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, 0, raw)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (m *pbEmpty) marshal() []byte {
+	return nil
+}
+
+func (m *pbEmpty) unmarshal(b []byte) error {
+	return walkFields(b, func(protowire.Number, uint64, []byte) {})
+}
+
+func (m *pbAddress) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Address))
+	return appendBytes(b, 2, marshalAuth(m.Auth))
+}
+
+func (m *pbAddress) unmarshal(b []byte) error {
+	var err error
+	walkErr := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			m.Address = string(raw)
+		case 2:
+			m.Auth, err = unmarshalAuth(raw)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func marshalAuth(a Auth) []byte {
+	b := appendBytes(nil, 1, []byte(a.Signer))
+	b = appendVarint(b, 2, uint64(a.Time))
+	return appendBytes(b, 3, a.MAC)
+}
+
+func unmarshalAuth(b []byte) (Auth, error) {
+	var a Auth
+	err := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			a.Signer = string(raw)
+		case 2:
+			a.Time = int64(v)
+		case 3:
+			a.MAC = append([]byte(nil), raw...)
+		}
+	})
+	return a, err
+}
+
+func marshalCred(c Cred) []byte {
+	b := appendBytes(nil, 1, []byte(c.Client))
+	b = appendVarint(b, 2, uint64(c.Time))
+	b = appendBytes(b, 3, c.Sig)
+	return appendVarint(b, 4, c.Nonce)
+}
+
+func unmarshalCred(b []byte) (Cred, error) {
+	var c Cred
+	err := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			c.Client = string(raw)
+		case 2:
+			c.Time = int64(v)
+		case 3:
+			c.Sig = append([]byte(nil), raw...)
+		case 4:
+			c.Nonce = v
+		}
+	})
+	return c, err
+}
+
+func (m *pbAck) marshal() []byte {
+	return appendVarint(nil, 1, protowire.EncodeBool(m.OK))
+}
+
+func (m *pbAck) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.OK = protowire.DecodeBool(v)
+		}
+	})
+}
+
+func (m *pbFindSuccessorRequest) marshal() []byte {
+	return appendBytes(nil, 1, m.ID)
+}
+
+func (m *pbFindSuccessorRequest) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.ID = append([]byte(nil), raw...)
+		}
+	})
+}
+
+func (m *pbPassSuccessorRequest) marshal() []byte {
+	return appendVarint(nil, 1, uint64(int64(m.Index)))
+}
+
+func (m *pbPassSuccessorRequest) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.Index = int32(v)
+		}
+	})
+}
+
+func (m *pbPingReply) marshal() []byte {
+	return appendVarint(nil, 1, uint64(m.Version))
+}
+
+func (m *pbPingReply) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.Version = uint32(v)
+		}
+	})
+}
+
+func (m *pbPutRequest) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Key))
+	b = appendBytes(b, 2, []byte(m.Value))
+	b = appendVarint(b, 3, uint64(m.Flags))
+	b = appendVarint(b, 4, m.Version)
+	b = appendBytes(b, 5, marshalCred(m.Cred))
+	return appendBytes(b, 6, marshalAuth(m.Auth))
+}
+
+func (m *pbPutRequest) unmarshal(b []byte) error {
+	var err error
+	walkErr := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			m.Key = string(raw)
+		case 2:
+			m.Value = string(raw)
+		case 3:
+			m.Flags = uint32(v)
+		case 4:
+			m.Version = v
+		case 5:
+			m.Cred, err = unmarshalCred(raw)
+		case 6:
+			m.Auth, err = unmarshalAuth(raw)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func marshalMigrateItem(item MigrateItem) []byte {
+	b := appendBytes(nil, 1, []byte(item.Key))
+	b = appendBytes(b, 2, []byte(item.Val))
+	b = appendVarint(b, 3, uint64(item.Flags))
+	b = appendVarint(b, 4, item.Version)
+	return appendVarint(b, 5, uint64(item.TTL))
+}
+
+func unmarshalMigrateItem(b []byte) (MigrateItem, error) {
+	var item MigrateItem
+	err := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			item.Key = string(raw)
+		case 2:
+			item.Val = string(raw)
+		case 3:
+			item.Flags = uint32(v)
+		case 4:
+			item.Version = v
+		case 5:
+			item.TTL = time.Duration(int64(v))
+		}
+	})
+	return item, err
+}
+
+func (m *pbMigrateBatchRequest) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Transfer))
+	b = appendVarint(b, 2, uint64(int64(m.Seq)))
+	for _, item := range m.Items {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalMigrateItem(item))
+	}
+	return appendBytes(b, 4, marshalAuth(m.Auth))
+}
+
+func (m *pbMigrateBatchRequest) unmarshal(b []byte) error {
+	var err error
+	walkErr := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			m.Transfer = string(raw)
+		case 2:
+			m.Seq = int32(v)
+		case 3:
+			var item MigrateItem
+			item, err = unmarshalMigrateItem(raw)
+			m.Items = append(m.Items, item)
+		case 4:
+			m.Auth, err = unmarshalAuth(raw)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func (m *pbMigrateBatchReply) marshal() []byte {
+	return appendVarint(nil, 1, uint64(int64(m.Seq)))
+}
+
+func (m *pbMigrateBatchReply) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.Seq = int32(v)
+		}
+	})
+}
+
+func (m *pbKey) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Key))
+	return appendBytes(b, 2, marshalCred(m.Cred))
+}
+
+func (m *pbKey) unmarshal(b []byte) error {
+	var err error
+	walkErr := walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			m.Key = string(raw)
+		case 2:
+			m.Cred, err = unmarshalCred(raw)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func (m *pbValue) marshal() []byte {
+	return appendBytes(nil, 1, []byte(m.Value))
+}
+
+func (m *pbValue) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.Value = string(raw)
+		}
+	})
+}
+
+func (m *pbInvokeRequest) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Method))
+	return appendBytes(b, 2, m.Args)
+}
+
+func (m *pbInvokeRequest) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			m.Method = string(raw)
+		case 2:
+			m.Args = append([]byte(nil), raw...)
+		}
+	})
+}
+
+func (m *pbInvokeReply) marshal() []byte {
+	return appendBytes(nil, 1, m.Reply)
+}
+
+func (m *pbInvokeReply) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, v uint64, raw []byte) {
+		if num == 1 {
+			m.Reply = append([]byte(nil), raw...)
+		}
+	})
+}
+
+// protoCodec lets gRPC carry wireMessages under the standard "proto" name,
+// so stubs generated from node.proto in other languages interoperate
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, errors.New("proto codec: unsupported message type")
+	}
+	return m.marshal(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return errors.New("proto codec: unsupported message type")
+	}
+	return m.unmarshal(data)
+}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+// localCodec feeds one call into the node's net/rpc server, so that gRPC
+// requests are dispatched exactly like net/rpc ones
+type localCodec struct {
+	method string
+	args, reply interface{}
+	err string
+}
+
+func (c *localCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.method
+	return nil
+}
+
+func (c *localCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	if b, ok := c.args.([]byte); ok {
+		return gob.NewDecoder(bytes.NewReader(b)).Decode(body)
+	}
+	arg := reflect.ValueOf(c.args)
+	if arg.Kind() == reflect.Ptr {
+		arg = arg.Elem()
+	}
+	reflect.ValueOf(body).Elem().Set(arg)
+	return nil
+}
+
+func (c *localCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		c.err = r.Error
+		return nil
+	}
+	if buf, ok := c.reply.(*bytes.Buffer); ok {
+		return gob.NewEncoder(buf).Encode(body)
+	}
+	reflect.ValueOf(c.reply).Elem().Set(reflect.ValueOf(body).Elem())
+	return nil
+}
+
+func (c *localCodec) Close() error {
+	return nil
+}
+
+// connListener hands connections routed by rpcServer.accept to gRPC
+type connListener struct {
+	conns chan net.Conn
+	done chan struct{}
+	once sync.Once
+	addr net.Addr
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// peekedConn replays the bytes read while routing a connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type grpcServer struct {
+	node *Node
+	rpc *rpc.Server
+	server *grpc.Server
+	listener *connListener
+}
+
+func newgrpcServer(n *Node, r *rpc.Server, addr net.Addr) *grpcServer {
+	s := &grpcServer{
+		node: n,
+		rpc: r,
+		server: grpc.NewServer(grpc.ForceServerCodec(protoCodec{})),
+		listener: &connListener{
+			conns: make(chan net.Conn),
+			done: make(chan struct{}),
+			addr: addr,
+		},
+	}
+	s.server.RegisterService(&nodeServiceDesc, s)
+	go s.server.Serve(s.listener)
+	return s
+}
+
+func (s *grpcServer) serve(conn net.Conn) {
+	select {
+	case s.listener.conns <- conn:
+	case <-s.listener.done:
+		conn.Close()
+	}
+}
+
+func (s *grpcServer) stop() {
+	s.server.Stop()
+}
+
+// call runs method on the node through its net/rpc server
+func (s *grpcServer) call(method string, args, reply interface{}) error {
+	codec := &localCodec{method: method, args: args, reply: reply}
+	err := s.rpc.ServeRequest(codec)
+	if codec.err != "" {
+		if codec.err == "rpc: can't find method " + method || codec.err == "rpc: can't find service " + method {
+			return status.Error(codes.Unimplemented, codec.err)
+		}
+		return status.Error(codes.Unknown, codec.err)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func grpcMethod(name string, in func() wireMessage, call func(s *grpcServer, in wireMessage) (wireMessage, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := in()
+			err := dec(req)
+			if err != nil {
+				return nil, err
+			}
+			s := srv.(*grpcServer)
+			method := "Node." + name
+			if invoke, ok := req.(*pbInvokeRequest); ok {
+				method = invoke.Method
+			}
+			var client string
+			if p, ok := peer.FromContext(ctx); ok {
+				client = clientOf(p.Addr)
+			}
+			err = s.node.admit(client, method)
+			if err != nil {
+				return nil, status.Error(codes.ResourceExhausted, err.Error())
+			}
+			return call(s, req)
+		},
+	}
+}
+
+var nodeServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcService,
+	HandlerType: (*interface{})(nil),
+	Metadata: "node.proto",
+	Methods: []grpc.MethodDesc{
+		grpcMethod("FindSuccessor", func() wireMessage { return &pbFindSuccessorRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply Address
+			err := s.call("Node.FindSuccessor", new(big.Int).SetBytes(in.(*pbFindSuccessorRequest).ID), &reply)
+			return &pbAddress{Address: reply.Addr, Auth: reply.Auth}, err
+		}),
+		grpcMethod("Notify", func() wireMessage { return &pbAddress{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.Notify", in.(*pbAddress).args(), &reply)
+			return &pbAck{OK: reply}, err
+		}),
+		grpcMethod("GetPredecessor", func() wireMessage { return &pbEmpty{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply string
+			err := s.call("Node.GetPredecessor", true, &reply)
+			return &pbAddress{Address: reply}, err
+		}),
+		grpcMethod("PassSuccessor", func() wireMessage { return &pbPassSuccessorRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply string
+			index := int(in.(*pbPassSuccessorRequest).Index)
+			if index < 0 || index >= len(s.node.successor) {
+				return nil, status.Error(codes.InvalidArgument, "pass successor: index out of range")
+			}
+			err := s.call("Node.PassSuccessor", index, &reply)
+			return &pbAddress{Address: reply}, err
+		}),
+		grpcMethod("Ping", func() wireMessage { return &pbEmpty{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.Ping", true, &reply)
+			return &pbPingReply{Version: protocolVersion}, err
+		}),
+		grpcMethod("Put", func() wireMessage { return &pbPutRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.Put", in.(*pbPutRequest).args(), &reply)
+			return &pbAck{OK: reply}, err
+		}),
+		grpcMethod("Get", func() wireMessage { return &pbKey{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply string
+			err := s.call("Node.Get", in.(*pbKey).args(), &reply)
+			return &pbValue{Value: reply}, err
+		}),
+		grpcMethod("Delete", func() wireMessage { return &pbKey{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.Delete", in.(*pbKey).args(), &reply)
+			return &pbAck{OK: reply}, err
+		}),
+		grpcMethod("MigrateWhenJoining", func() wireMessage { return &pbAddress{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.MigrateWhenJoining", in.(*pbAddress).args(), &reply)
+			return &pbAck{OK: reply}, err
+		}),
+		grpcMethod("Migrate", func() wireMessage { return &pbPutRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply bool
+			err := s.call("Node.Migrate", in.(*pbPutRequest).args(), &reply)
+			return &pbAck{OK: reply}, err
+		}),
+		grpcMethod("MigrateBatch", func() wireMessage { return &pbMigrateBatchRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			var reply int
+			err := s.call("Node.MigrateBatch", in.(*pbMigrateBatchRequest).args(), &reply)
+			return &pbMigrateBatchReply{Seq: int32(reply)}, err
+		}),
+		grpcMethod("Invoke", func() wireMessage { return &pbInvokeRequest{} }, func(s *grpcServer, in wireMessage) (wireMessage, error) {
+			req := in.(*pbInvokeRequest)
+			var reply bytes.Buffer
+			err := s.call(req.Method, req.Args, &reply)
+			return &pbInvokeReply{Reply: reply.Bytes()}, err
+		}),
+	},
+}
+
+func (m *pbAddress) args() Address {
+	return Address{Addr: m.Address, Auth: m.Auth}
+}
+
+func (m *pbPutRequest) args() PutArgs {
+	return PutArgs {
+		Key: m.Key,
+		Val: m.Value,
+		Flags: m.Flags,
+		Version: m.Version,
+		Cred: m.Cred,
+		Auth: m.Auth,
+	}
+}
+
+func (m *pbMigrateBatchRequest) args() MigrateBatchArgs {
+	return MigrateBatchArgs {
+		Transfer: m.Transfer,
+		Seq: int(m.Seq),
+		Items: m.Items,
+		Auth: m.Auth,
+	}
+}
+
+func (m *pbKey) args() KeyArgs {
+	return KeyArgs{Key: m.Key, Cred: m.Cred}
+}
+
+// grpcClient bridges net/rpc style calls onto node.proto; calls without a
+// typed counterpart go through the Invoke tunnel
+type grpcClient struct {
+	conn *grpc.ClientConn
+	key string
+}
+
+var grpcConns = struct {
+	sync.Mutex
+	m map[string]*grpc.ClientConn
+}{m: make(map[string]*grpc.ClientConn)}
+
+// dialGRPC returns nil when addr can't be reached, like dial does;
+// connections are cached per caller and redialed when its certificates
+// are reloaded
+func (n *Node) dialGRPC(addr string) *grpcClient {
+	creds := insecure.NewCredentials()
+	key := n.IP + ">" + addr
+	if n.tls != nil {
+		_, _, generation := n.tls.current()
+		creds = credentials.NewTLS(n.tls.clientConfig(addr))
+		key += "#" + strconv.Itoa(generation)
+	}
+	grpcConns.Lock()
+	conn, ok := grpcConns.m[key]
+	if !ok {
+		var err error
+		conn, err = grpc.NewClient("passthrough:///" + addr,
+			grpc.WithTransportCredentials(creds),
+			grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})))
+		if err != nil {
+			grpcConns.Unlock()
+			return nil
+		}
+		grpcConns.m[key] = conn
+	}
+	grpcConns.Unlock()
+	if !waitReady(conn) {
+		forgetGRPC(key, conn)
+		return nil
+	}
+	return &grpcClient{conn: conn, key: key}
+}
+
+func waitReady(conn *grpc.ClientConn) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return false
+		case connectivity.Idle:
+			conn.Connect()
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
+func forgetGRPC(key string, conn *grpc.ClientConn) {
+	grpcConns.Lock()
+	if grpcConns.m[key] == conn {
+		delete(grpcConns.m, key)
+	}
+	grpcConns.Unlock()
+	conn.Close()
+}
+
+func (c *grpcClient) invoke(method string, in, out wireMessage) error {
+	err := c.conn.Invoke(context.Background(), "/" + grpcService + "/" + method, in, out)
+	if err != nil {
+		st := status.Convert(err)
+		if st.Code() == codes.Unavailable {
+			forgetGRPC(c.key, c.conn)
+		}
+		if st.Code() == codes.Unimplemented {
+			return errors.New("unimplemented: " + st.Message())
+		}
+		return errors.New(st.Message())
+	}
+	return nil
+}
+
+// Call exported
+func (c *grpcClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	switch serviceMethod {
+	case "Node.FindSuccessor":
+		out := &pbAddress{}
+		err := c.invoke("FindSuccessor", &pbFindSuccessorRequest{ID: args.(*big.Int).Bytes()}, out)
+		*reply.(*Address) = out.args()
+		return err
+	case "Node.Notify":
+		out := &pbAck{}
+		a := args.(Address)
+		err := c.invoke("Notify", &pbAddress{Address: a.Addr, Auth: a.Auth}, out)
+		*reply.(*bool) = out.OK
+		return err
+	case "Node.GetPredecessor":
+		out := &pbAddress{}
+		err := c.invoke("GetPredecessor", &pbEmpty{}, out)
+		*reply.(*string) = out.Address
+		return err
+	case "Node.PassSuccessor":
+		out := &pbAddress{}
+		err := c.invoke("PassSuccessor", &pbPassSuccessorRequest{Index: int32(args.(int))}, out)
+		*reply.(*string) = out.Address
+		return err
+	case "Node.Ping":
+		out := &pbPingReply{}
+		err := c.invoke("Ping", &pbEmpty{}, out)
+		if err == nil && out.Version != protocolVersion {
+			return errors.New("ping: unsupported protocol version")
+		}
+		return err
+	case "Node.Put", "Node.Migrate":
+		a := args.(PutArgs)
+		out := &pbAck{}
+		err := c.invoke(serviceMethod[len("Node."):], &pbPutRequest{Key: a.Key, Value: a.Val, Flags: a.Flags, Version: a.Version, Cred: a.Cred, Auth: a.Auth}, out)
+		*reply.(*bool) = out.OK
+		return err
+	case "Node.Get":
+		out := &pbValue{}
+		a := args.(KeyArgs)
+		err := c.invoke("Get", &pbKey{Key: a.Key, Cred: a.Cred}, out)
+		*reply.(*string) = out.Value
+		return err
+	case "Node.Delete":
+		out := &pbAck{}
+		a := args.(KeyArgs)
+		err := c.invoke("Delete", &pbKey{Key: a.Key, Cred: a.Cred}, out)
+		*reply.(*bool) = out.OK
+		return err
+	case "Node.MigrateBatch":
+		out := &pbMigrateBatchReply{}
+		a := args.(MigrateBatchArgs)
+		err := c.invoke("MigrateBatch", &pbMigrateBatchRequest{Transfer: a.Transfer, Seq: int32(a.Seq), Items: a.Items, Auth: a.Auth}, out)
+		*reply.(*int) = int(out.Seq)
+		return err
+	case "Node.MigrateWhenJoining":
+		out := &pbAck{}
+		a := args.(Address)
+		err := c.invoke("MigrateWhenJoining", &pbAddress{Address: a.Addr, Auth: a.Auth}, out)
+		*reply.(*bool) = out.OK
+		return err
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(args)
+	if err != nil {
+		return err
+	}
+	out := &pbInvokeReply{}
+	err = c.invoke("Invoke", &pbInvokeRequest{Method: serviceMethod, Args: buf.Bytes()}, out)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(out.Reply)).Decode(reply)
+}
+
+// isUnimplemented tells whether err is a peer's answer to a method it
+// doesn't have, over net/rpc or gRPC
+func isUnimplemented(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "unimplemented: ") || strings.HasPrefix(err.Error(), "rpc: can't find "))
+}
+
+// Close exported
+// connections are shared between calls, so closing is a no-op
+func (c *grpcClient) Close() error {
+	return nil
+}
@@ -0,0 +1,489 @@
+package dht
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// hotWindow is how often request rates are measured
+	hotWindow = time.Second
+	// hotLease is how long a read replica serves unless renewed
+	hotLease = 5 * time.Second
+	// hotReplicas is how many nodes before the owner get a read replica
+	hotReplicas = 3
+	// defaultHotRate is the requests per second that make a key hot
+	defaultHotRate = 100
+)
+
+// ReadReply exported
+// a value and where it was read from; Replica marks a value served from a
+// read replica of a hot key rather than by its owner
+type ReadReply struct {
+	Val, From, Owner string
+	Version uint64
+	Replica bool
+	// Replicas lists the nodes holding read replicas of a hot key, for the
+	// next Lease
+	Replicas []string
+	Lease time.Duration
+}
+
+// ReplicaArgs exported
+type ReplicaArgs struct {
+	Key, Val, Owner string
+	Version uint64
+	Lease time.Duration
+	Auth Auth
+}
+
+// InvalidateArgs exported
+type InvalidateArgs struct {
+	Key string
+	Auth Auth
+}
+
+// HotKey exported
+type HotKey struct {
+	Key string
+	Rate float64
+}
+
+// heatTable counts the requests a node answers as owner, per key
+type heatTable struct {
+	lock sync.Mutex
+	hits map[string]int
+	rates map[string]float64
+}
+
+func (h *heatTable) hit(key string, count int) {
+	h.lock.Lock()
+	h.hits[key] += count
+	h.lock.Unlock()
+}
+
+// cool folds the requests of the last window into the smoothed rates and
+// returns the keys at least threshold hot
+func (h *heatTable) cool(threshold float64) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for key := range h.hits {
+		if _, ok := h.rates[key]; !ok {
+			h.rates[key] = 0
+		}
+	}
+	var hot []string
+	for key, rate := range h.rates {
+		rate = (rate + float64(h.hits[key]) / hotWindow.Seconds()) / 2
+		h.rates[key] = rate
+		if rate < 0.5 {
+			delete(h.rates, key)
+		} else if threshold > 0 && rate >= threshold {
+			hot = append(hot, key)
+		}
+	}
+	h.hits = make(map[string]int)
+	return hot
+}
+
+func (h *heatTable) snapshot() []HotKey {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var keys []HotKey
+	for key, rate := range h.rates {
+		keys = append(keys, HotKey{Key: key, Rate: rate})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Rate > keys[j].Rate
+	})
+	return keys
+}
+
+type replica struct {
+	val, owner string
+	version uint64
+	expires time.Time
+	hits int
+}
+
+type replicaHint struct {
+	addrs []string
+	expires time.Time
+}
+
+// replicaStore keeps the read replicas n holds for other owners, the
+// holders of the replicas n handed out of its own hot keys, and the
+// replicas n was told about when reading
+type replicaStore struct {
+	lock sync.Mutex
+	held map[string]*replica
+	holders map[string]map[string]time.Time
+	hints map[string]replicaHint
+	hot map[string]bool
+}
+
+// read returns the replica of key n holds, if its lease still runs
+func (s *replicaStore) read(key string) (replica, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.held[key]
+	if !ok || time.Now().After(r.expires) {
+		return replica{}, false
+	}
+	r.hits++
+	return *r, true
+}
+
+// holding lists the nodes whose replica of key is still leased
+func (s *replicaStore) holding(key string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var addrs []string
+	for addr, expires := range s.holders[key] {
+		if time.Now().Before(expires) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// hint picks one of the nodes known to serve key, or "" when none is
+func (s *replicaStore) hint(key string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h, ok := s.hints[key]
+	if !ok || time.Now().After(h.expires) || len(h.addrs) == 0 {
+		delete(s.hints, key)
+		return ""
+	}
+	return h.addrs[rand.Intn(len(h.addrs))]
+}
+
+// Replica exported
+// stores a read replica of a hot key for its owner, answering with how many
+// reads the previous one served
+func (n *Node) Replica(args ReplicaArgs, hits *int) error {
+	if !n.verify(args.Auth, args.Owner, "replica", args.Key, strconv.FormatUint(args.Version, 10)) {
+		n.auth.reject("replica")
+		return errors.New("replica: not signed by the owner")
+	}
+	n.replicas.lock.Lock()
+	defer n.replicas.lock.Unlock()
+	if r, ok := n.replicas.held[args.Key]; ok {
+		*hits = r.hits
+	}
+	n.replicas.held[args.Key] = &replica {
+		val: args.Val,
+		owner: args.Owner,
+		version: args.Version,
+		expires: time.Now().Add(args.Lease),
+	}
+	return nil
+}
+
+// Invalidate exported
+// drops the read replica of a key its owner wrote
+func (n *Node) Invalidate(args InvalidateArgs, reply *bool) error {
+	n.replicas.lock.Lock()
+	defer n.replicas.lock.Unlock()
+	r, ok := n.replicas.held[args.Key]
+	if !ok {
+		return nil
+	}
+	if !n.verify(args.Auth, r.owner, "invalidate", args.Key) {
+		n.auth.reject("invalidate")
+		return errors.New("invalidate: not signed by the owner")
+	}
+	delete(n.replicas.held, args.Key)
+	*reply = true
+	return nil
+}
+
+// invalidate drops every leased replica of key before a write to it is
+// acknowledged; a holder that can't be reached serves the old value at
+// most until its lease runs out
+func (n *Node) invalidate(key string) {
+	n.replicas.lock.Lock()
+	holders := n.replicas.holders[key]
+	delete(n.replicas.holders, key)
+	n.replicas.lock.Unlock()
+	var wg sync.WaitGroup
+	for addr, expires := range holders {
+		if time.Now().After(expires) {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			client := n.dial(addr)
+			if client == nil {
+				Cyan.Println(TimeClock(), "invalidate: client offline, replica of", key, "at", addr, "lapses with its lease")
+				return
+			}
+			defer client.Close()
+			var reply bool
+			err := client.Call("Node.Invalidate", InvalidateArgs{Key: key, Auth: n.sign("invalidate", key)}, &reply)
+			if err != nil {
+				Cyan.Println(TimeClock(), "invalidate:", err, "replica of", key, "at", addr, "lapses with its lease")
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// Read exported
+// Get telling where the value came from: the owner answers, counting the
+// request towards the key's heat and naming the replicas of a hot key, and
+// a node holding a leased replica answers from it, marked as such
+func (n *Node) Read(args KeyArgs, reply *ReadReply) error {
+	if ok, err := n.readReplica(args, reply); ok {
+		return err
+	}
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermRead, args.Key, "")
+	if err != nil {
+		return err
+	}
+	n.expire(args.Key)
+	n.heat.hit(args.Key, 1)
+	n.dataLock.Lock()
+	val, version := n.data[args.Key], n.version[args.Key]
+	n.dataLock.Unlock()
+	*reply = ReadReply {
+		Val: val,
+		From: n.IP,
+		Owner: n.IP,
+		Version: version,
+		Replicas: n.replicas.holding(args.Key),
+		Lease: hotLease,
+	}
+	return nil
+}
+
+// readReplica answers from the replica of a key n doesn't own, when it
+// holds one
+func (n *Node) readReplica(args KeyArgs, reply *ReadReply) (bool, error) {
+	if n.owns(args.Key) {
+		return false, nil
+	}
+	r, ok := n.replicas.read(args.Key)
+	if !ok {
+		return false, nil
+	}
+	err := n.allow(args.Cred, PermRead, args.Key, "")
+	if err != nil {
+		return true, err
+	}
+	*reply = ReadReply {
+		Val: r.val,
+		From: n.IP,
+		Owner: r.owner,
+		Version: r.version,
+		Replica: true,
+	}
+	return true, nil
+}
+
+// read reads key from the local replica, from one of the replicas the owner
+// named when key was last read, or from the owner
+func (n *Node) read(key string) (ReadReply, error) {
+	return n.readAt(key, "")
+}
+
+// readAt is read for a caller that already looked up owner, the owner of key;
+// an empty owner is looked up when needed
+func (n *Node) readAt(key, owner string) (ReadReply, error) {
+	args := KeyArgs{Key: key, Cred: n.credential(PermRead, key, "")}
+	var reply ReadReply
+	if ok, err := n.readReplica(args, &reply); ok && err == nil {
+		return reply, nil
+	}
+	if addr := n.replicas.hint(key); addr != "" {
+		reply = ReadReply{}
+		_, err := n.callAt(addr, key, "Read", args, &reply)
+		if err == nil {
+			return reply, nil
+		}
+		n.replicas.lock.Lock()
+		delete(n.replicas.hints, key)
+		n.replicas.lock.Unlock()
+	}
+	reply = ReadReply{}
+	var err error
+	if owner != "" {
+		_, err = n.callAt(owner, key, "Read", args, &reply)
+	} else {
+		_, err = n.callOwner(key, "Read", args, &reply)
+	}
+	if err != nil {
+		return reply, err
+	}
+	if len(reply.Replicas) > 0 {
+		n.replicas.lock.Lock()
+		n.replicas.hints[key] = replicaHint {
+			addrs: append([]string{reply.From}, reply.Replicas...),
+			expires: time.Now().Add(reply.Lease),
+		}
+		n.replicas.lock.Unlock()
+	}
+	return reply, nil
+}
+
+// readers are the nodes right before n, through which most lookups of the
+// keys n owns pass last
+func (n *Node) readers() []string {
+	var addrs []string
+	addr := n.predecessor
+	for len(addrs) < hotReplicas && addr != "" && addr != n.IP {
+		addrs = append(addrs, addr)
+		pred, err := n.rpcGetPredecessor(addr)
+		if err != nil {
+			break
+		}
+		addr = pred
+	}
+	return addrs
+}
+
+// replicate pushes the current value of a hot key to addr, making sure a
+// write racing the push invalidates it again
+func (n *Node) replicate(key, addr string) {
+	n.dataLock.Lock()
+	val, ok := n.data[key]
+	version := n.version[key]
+	lease := hotLease
+	if ttl := n.ttl(key); ttl > 0 && ttl < lease {
+		lease = ttl
+	}
+	n.dataLock.Unlock()
+	if !ok {
+		return
+	}
+	client := n.dial(addr)
+	if client == nil {
+		return
+	}
+	defer client.Close()
+	n.replicas.lock.Lock()
+	if n.replicas.holders[key] == nil {
+		n.replicas.holders[key] = make(map[string]time.Time)
+	}
+	n.replicas.holders[key][addr] = time.Now().Add(lease + hotWindow)
+	n.replicas.lock.Unlock()
+	args := ReplicaArgs {
+		Key: key,
+		Val: val,
+		Owner: n.IP,
+		Version: version,
+		Lease: lease,
+		Auth: n.sign("replica", key, strconv.FormatUint(version, 10)),
+	}
+	var hits int
+	err := client.Call("Node.Replica", args, &hits)
+	if err != nil {
+		Cyan.Println(TimeClock(), "replica:", err, "for", key, "at", addr)
+		return
+	}
+	n.heat.hit(key, hits)
+	n.dataLock.Lock()
+	changed := n.version[key] != version
+	n.dataLock.Unlock()
+	if changed {
+		n.invalidate(key)
+	}
+}
+
+// replicateHotKeysPeriodically measures request rates, hands leased read
+// replicas of the hot keys n owns to the nodes before it and drops the
+// replicas n holds whose lease ran out; a key that cools down is no longer
+// renewed and its replicas lapse
+func (n *Node) replicateHotKeysPeriodically() {
+	period := time.NewTicker(hotWindow)
+	defer period.Stop()
+	for n.tick(period) {
+		n.replicas.lock.Lock()
+		for key, r := range n.replicas.held {
+			if time.Now().After(r.expires) {
+				delete(n.replicas.held, key)
+			}
+		}
+		n.replicas.lock.Unlock()
+		hot := make(map[string]bool)
+		for _, key := range n.heat.cool(n.hotRate) {
+			if n.owns(key) {
+				hot[key] = true
+			}
+		}
+		n.replicas.lock.Lock()
+		for key := range hot {
+			if !n.replicas.hot[key] {
+				Yellow.Println(TimeClock(), "hot key", key, "at", n.IP)
+			}
+		}
+		for key := range n.replicas.hot {
+			if !hot[key] {
+				Yellow.Println(TimeClock(), "hot key", key, "cooled down at", n.IP)
+			}
+		}
+		n.replicas.hot = hot
+		n.replicas.lock.Unlock()
+		if len(hot) == 0 {
+			continue
+		}
+		readers := n.readers()
+		for key := range hot {
+			for _, addr := range readers {
+				n.replicate(key, addr)
+			}
+		}
+	}
+}
+
+// Read exported
+func (c *Chord) Read(key string) (ReadReply, error) {
+	if c.Node == nil {
+		return ReadReply{}, errors.New("Read: have not created or joined")
+	}
+	return c.Node.read(key)
+}
+
+// HotKeys exported
+// the keys this node answered for lately, hottest first, in requests per
+// second
+func (c *Chord) HotKeys() []HotKey {
+	if c.Node == nil {
+		return nil
+	}
+	return c.Node.heat.snapshot()
+}
+
+// HotCmd exported
+// hot <requests-per-second> sets how often a key is read before it gets
+// read replicas; hot off stops replicating
+func (c *Chord) HotCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Hot: expect requests per second or off")
+	}
+	rate := -1.0
+	if args[0] != "off" {
+		var err error
+		rate, err = strconv.ParseFloat(args[0], 64)
+		if err != nil || rate <= 0 {
+			return errors.New("Hot: expect requests per second or off")
+		}
+	}
+	c.hotRate = rate
+	if c.Node != nil {
+		c.Node.hotRate = rate
+	}
+	Magenta.Printf("%v Hot key threshold %v\n", TimeClock(), args[0])
+	return nil
+}
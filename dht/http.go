@@ -0,0 +1,219 @@
+package dht
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type httpServer struct {
+	node     *Node
+	addr     string
+	listener net.Listener
+}
+
+type kvReply struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Replica string `json:"replica,omitempty"`
+}
+
+type ringReply struct {
+	Address     string   `json:"address"`
+	ID          string   `json:"id"`
+	Predecessor string   `json:"predecessor"`
+	Successors  []string `json:"successors"`
+	Ring        []string `json:"ring"`
+}
+
+type blobReply struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Chunks int    `json:"chunks"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+func newhttpServer(n *Node, port string) *httpServer {
+	return &httpServer{
+		node: n,
+		addr: withPort(n.IP, port),
+	}
+}
+
+func (s *httpServer) listen() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", s.handleKV)
+	mux.HandleFunc("/blob/", s.handleBlob)
+	mux.HandleFunc("/ring", s.handleRing)
+	mux.HandleFunc("/health", s.handleHealth)
+	l, err := s.node.listen(s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go http.Serve(l, mux)
+	return nil
+}
+
+func (s *httpServer) quit() {
+	s.listener.Close()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeJSON(w, code, errorReply{Error: err})
+}
+
+// readValue accepts either a raw body or a JSON object {"value": "..."}, at
+// most maxItemSize bytes of it
+func readValue(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxItemSize))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req kvReply
+		err = json.Unmarshal(body, &req)
+		return req.Value, err
+	}
+	return string(body), nil
+}
+
+func (s *httpServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "lack valid key")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	addr, err := s.node.lookup(key)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	if addr == "" {
+		writeError(w, http.StatusServiceUnavailable, "no route to owner of "+key)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		read, err := s.node.readAt(key, addr)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+		} else if read.Val == "" {
+			writeError(w, http.StatusNotFound, "match not found")
+		} else if read.Replica {
+			writeJSON(w, http.StatusOK, kvReply{Key: key, Value: read.Val, Owner: read.Owner, Replica: read.From})
+		} else {
+			writeJSON(w, http.StatusOK, kvReply{Key: key, Value: read.Val, Owner: read.From})
+		}
+	case http.MethodPut:
+		val, err := readValue(w, r)
+		if _, large := err.(*http.MaxBytesError); large {
+			writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+			return
+		}
+		if err != nil || val == "" {
+			writeError(w, http.StatusBadRequest, "lack valid value")
+			return
+		}
+		err = s.node.rpcPut(addr, PutArgs{Key: key, Val: val})
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		Magenta.Printf("%v HTTP Put (%v, %v) at %v\n", TimeClock(), key, val, addr)
+		writeJSON(w, http.StatusOK, kvReply{Key: key, Value: val, Owner: addr})
+	case http.MethodDelete:
+		ok, err := s.node.rpcDelete(addr, key)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+		} else if !ok {
+			writeError(w, http.StatusNotFound, "match not found")
+		} else {
+			Magenta.Printf("%v HTTP Deleted key %v at %v\n", TimeClock(), key, addr)
+			writeJSON(w, http.StatusOK, kvReply{Key: key, Owner: addr})
+		}
+	}
+}
+
+// handleBlob streams large values in and out without holding them whole
+func (s *httpServer) handleBlob(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/blob/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "lack valid key")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		m, err := s.node.manifest(key)
+		if err == errBlobNotFound {
+			writeError(w, http.StatusNotFound, "match not found")
+			return
+		} else if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+		err = s.node.readChunks(m, w)
+		if err != nil {
+			Yellow.Println(TimeClock(), "HTTP blob", key, err)
+		}
+	case http.MethodPut:
+		m, err := s.node.putBlob(key, r.Body)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		Magenta.Printf("%v HTTP Put blob %v, %v bytes\n", TimeClock(), key, m.Size)
+		writeJSON(w, http.StatusOK, blobReply{Key: key, Size: m.Size, Chunks: len(m.Chunks)})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *httpServer) handleRing(w http.ResponseWriter, r *http.Request) {
+	n := s.node
+	writeJSON(w, http.StatusOK, ringReply{
+		Address:     n.IP,
+		ID:          n.id.Text(16),
+		Predecessor: n.predecessor,
+		Successors:  n.successor[:],
+		Ring:        n.ring(),
+	})
+}
+
+func (s *httpServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.node.listening {
+		writeError(w, http.StatusServiceUnavailable, "not listening")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "address": s.node.IP})
+}
+
+// errorStatus tells ACL refusals apart from an unreachable owner
+func errorStatus(err error) int {
+	if strings.HasPrefix(err.Error(), "acl: ") {
+		return http.StatusForbidden
+	}
+	return http.StatusServiceUnavailable
+}
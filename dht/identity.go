@@ -0,0 +1,217 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// identityTTL is how long a verified peer ID is trusted before refetching
+const identityTTL = time.Minute
+
+// IdentityPolicy exported
+// when set, node IDs are derived from public keys instead of addresses;
+// Difficulty is the number of leading zero bits a key's proof of work must
+// have, and Admin, if set, must have certified every node's key
+type IdentityPolicy struct {
+	Difficulty int
+	Admin ed25519.PublicKey
+}
+
+// Identity exported
+// what a node presents to prove its ID; Sig is the node's own signature
+// binding the key to its address, Cert the optional admin certificate
+type Identity struct {
+	Addr string
+	PubKey []byte
+	Nonce uint64
+	Sig, Cert []byte
+}
+
+type verifiedID struct {
+	id *big.Int
+	at time.Time
+}
+
+type identityCache struct {
+	lock sync.Mutex
+	ids map[string]verifiedID
+}
+
+func identityDigest(pub []byte, nonce uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, nonce)
+	return append(append([]byte(nil), pub...), buf...)
+}
+
+func leadingZeros(b []byte) int {
+	count := 0
+	for _, x := range b {
+		if x != 0 {
+			return count + bits.LeadingZeros8(x)
+		}
+		count += 8
+	}
+	return count
+}
+
+// MineIdentity exported
+// finds a nonce whose proof of work for pub meets difficulty
+func MineIdentity(pub ed25519.PublicKey, difficulty int) uint64 {
+	for nonce := uint64(0); ; nonce++ {
+		work := sha256.Sum256(identityDigest(pub, nonce))
+		if leadingZeros(work[:]) >= difficulty {
+			return nonce
+		}
+	}
+}
+
+// CertifyNode exported
+// is run by the ring admin to allow pub to join at addr with the ID nonce
+// gives it, so that a certified node can't pick another position
+func CertifyNode(admin ed25519.PrivateKey, addr string, pub ed25519.PublicKey, nonce uint64) []byte {
+	return ed25519.Sign(admin, certMessage(addr, pub, nonce))
+}
+
+func certMessage(addr string, pub []byte, nonce uint64) []byte {
+	return append([]byte("cert|" + addr + "|"), identityDigest(pub, nonce)...)
+}
+
+func (ident *Identity) id() *big.Int {
+	sum := sha1.Sum(identityDigest(ident.PubKey, ident.Nonce))
+	return new(big.Int).SetBytes(sum[:])
+}
+
+func (ident *Identity) message() []byte {
+	return append([]byte("identity|" + ident.Addr + "|"), identityDigest(ident.PubKey, ident.Nonce)...)
+}
+
+// check returns the ID ident proves under p
+func (p *IdentityPolicy) check(ident Identity) (*big.Int, error) {
+	if len(ident.PubKey) != ed25519.PublicKeySize {
+		return nil, errors.New("identity: bad public key")
+	}
+	pub := ed25519.PublicKey(ident.PubKey)
+	if !ed25519.Verify(pub, ident.message(), ident.Sig) {
+		return nil, errors.New("identity: bad signature")
+	}
+	work := sha256.Sum256(identityDigest(ident.PubKey, ident.Nonce))
+	if leadingZeros(work[:]) < p.Difficulty {
+		return nil, errors.New("identity: insufficient proof of work")
+	}
+	if p.Admin != nil && !ed25519.Verify(p.Admin, certMessage(ident.Addr, ident.PubKey, ident.Nonce), ident.Cert) {
+		return nil, errors.New("identity: not certified by admin")
+	}
+	return ident.id(), nil
+}
+
+// setIdentity switches n to a key-derived ID under policy
+func (n *Node) setIdentity(policy *IdentityPolicy, key ed25519.PrivateKey, nonce uint64, cert []byte) error {
+	pub := key.Public().(ed25519.PublicKey)
+	ident := Identity {
+		Addr: n.IP,
+		PubKey: pub,
+		Nonce: nonce,
+		Cert: cert,
+	}
+	ident.Sig = ed25519.Sign(key, ident.message())
+	id, err := policy.check(ident)
+	if err != nil {
+		return err
+	}
+	n.policy = policy
+	n.identity = ident
+	n.id = id
+	return nil
+}
+
+// Identity exported
+func (n *Node) Identity(none bool, reply *Identity) error {
+	if n.policy == nil {
+		return errors.New("identity: node IDs are address based")
+	}
+	*reply = n.identity
+	return nil
+}
+
+func (n *Node) rpcIdentity(addr string) (Identity, error) {
+	var reply Identity
+	client := n.dial(addr)
+	if client == nil {
+		return reply, errors.New("identity: client offline")
+	}
+	defer client.Close()
+	err := client.Call("Node.Identity", true, &reply)
+	return reply, err
+}
+
+// verifyPeer fetches and checks the identity of addr, caching the result
+func (n *Node) verifyPeer(addr string) (*big.Int, error) {
+	if n.policy == nil && n.balance != nil {
+		return n.position(addr)
+	}
+	if n.policy == nil {
+		return hashString(addr), nil
+	}
+	if addr == n.IP {
+		return n.id, nil
+	}
+	if addr == "" {
+		return nil, errors.New("identity: lack valid address")
+	}
+	n.ids.lock.Lock()
+	v, ok := n.ids.ids[addr]
+	n.ids.lock.Unlock()
+	if ok && time.Since(v.at) < identityTTL {
+		return v.id, nil
+	}
+	ident, err := n.rpcIdentity(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ident.Addr != addr {
+		return nil, errors.New("identity: presented for " + ident.Addr)
+	}
+	id, err := n.policy.check(ident)
+	if err != nil {
+		return nil, err
+	}
+	n.ids.lock.Lock()
+	n.ids.ids[addr] = verifiedID{id: id, at: time.Now()}
+	n.ids.lock.Unlock()
+	return id, nil
+}
+
+// trusted reports whether addr proves its ID, counting failures
+func (n *Node) trusted(addr, what string) bool {
+	_, err := n.verifyPeer(addr)
+	if err != nil {
+		n.auth.reject("identity")
+		Yellow.Println(TimeClock(), what + ": reject", addr, err)
+		return false
+	}
+	return true
+}
+
+// idOf is the ring position of the node at addr; peers that can't be
+// verified are refused before they get here, so the address hash is only a
+// fallback
+func (n *Node) idOf(addr string) *big.Int {
+	id, err := n.verifyPeer(addr)
+	if err != nil {
+		return hashString(addr)
+	}
+	return id
+}
+
+// NewIdentityKey exported
+func NewIdentityKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
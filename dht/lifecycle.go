@@ -0,0 +1,313 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State exported
+// where a Chord is in its life; Start and Shutdown move it along and do
+// nothing when it is already where they would take it
+type State int
+
+const (
+	// Stopped exported
+	Stopped State = iota
+	// Starting exported
+	Starting
+	// Running exported
+	Running
+	// Stopping exported
+	Stopping
+)
+
+var stateNames = [...]string{"stopped", "starting", "running", "stopping"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// ErrStopping is what calls get from a node that is shutting down
+var ErrStopping = errors.New("stopping: node is shutting down")
+
+// inflight counts work a node has under way; once closed it still counts
+// what comes in but tells the caller to refuse it
+type inflight struct {
+	lock sync.Mutex
+	count int
+	closing bool
+	drained chan struct{}
+}
+
+// begin counts one more piece of work and reports whether it may run;
+// every begin is matched by an end
+func (f *inflight) begin() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.count++
+	return !f.closing
+}
+
+func (f *inflight) end() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.count--
+	if f.count == 0 && f.drained != nil {
+		close(f.drained)
+		f.drained = nil
+	}
+}
+
+// close refuses new work and returns a channel closed once the work under
+// way is done
+func (f *inflight) close() <-chan struct{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closing = true
+	if f.drained != nil {
+		return f.drained
+	}
+	drained := make(chan struct{})
+	if f.count == 0 {
+		close(drained)
+	} else {
+		f.drained = drained
+	}
+	return drained
+}
+
+// spawn runs f in the background unless n is shutting down; shutdown waits
+// for it to return
+func (n *Node) spawn(f func()) {
+	if !n.tasks.begin() {
+		n.tasks.end()
+		return
+	}
+	go func() {
+		defer n.tasks.end()
+		f()
+	}()
+}
+
+// stop ends the background loops of n
+func (n *Node) stop() {
+	n.listening = false
+	n.stopOnce.Do(func() {
+		close(n.stopped)
+	})
+}
+
+// tick waits for the next tick of period and reports false once n stops
+func (n *Node) tick(period *time.Ticker) bool {
+	select {
+	case <-n.stopped:
+		return false
+	case <-period.C:
+		return true
+	}
+}
+
+// pause sleeps for d and reports false if n stopped meanwhile
+func (n *Node) pause(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-n.stopped:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// wait waits for done until ctx is done
+func wait(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Chord) setState(s State) {
+	c.life.Lock()
+	c.state = s
+	c.life.Unlock()
+}
+
+// State exported
+func (c *Chord) State() State {
+	c.life.Lock()
+	defer c.life.Unlock()
+	return c.state
+}
+
+// Start exported
+// creates a ring, or joins the one at addr, and returns once the node
+// serves. ctx bounds the join; a node that hasn't joined when ctx is done is
+// shut down again. Starting a running node does nothing
+func (c *Chord) Start(ctx context.Context, addr ...string) error {
+	c.life.Lock()
+	switch c.state {
+	case Running:
+		c.life.Unlock()
+		return nil
+	case Starting, Stopping:
+		c.life.Unlock()
+		return errors.New("Start: node is " + c.state.String())
+	}
+	c.state = Starting
+	c.life.Unlock()
+	err := ctx.Err()
+	if err == nil {
+		err = c.dispatch()
+		if err != nil {
+			c.Node = nil
+		}
+	}
+	if err != nil {
+		c.setState(Stopped)
+		return err
+	}
+	return c.launch(ctx, addr...)
+}
+
+// launch brings up the node made by dispatch; on failure nothing is left
+// listening and c is stopped again
+func (c *Chord) launch(ctx context.Context, addr ...string) error {
+	s := c.server
+	err := s.listen()
+	if err != nil {
+		s.node.file.Close()
+		c.Node = nil
+		c.server = nil
+		c.setState(Stopped)
+		return err
+	}
+	if len(addr) > 0 {
+		joined := make(chan error, 1)
+		go func() {
+			joined <- s.node.join(addr[0])
+		}()
+		select {
+		case err = <-joined:
+		case <-ctx.Done():
+			err = ctx.Err()
+			c.Node = nil
+			c.server = nil
+			c.setState(Stopping)
+			go func() {
+				<-joined
+				s.quit(context.Background())
+				c.setState(Stopped)
+			}()
+			return err
+		}
+		if err != nil {
+			s.quit(context.Background())
+			c.Node = nil
+			c.server = nil
+			c.setState(Stopped)
+			return err
+		}
+		s.node.spawn(c.recover)
+	}
+	c.setState(Running)
+	return nil
+}
+
+// Shutdown exported
+// hands the node's keys to its successor and stops it, waiting for the
+// calls it is serving and its background work until ctx is done, after
+// which whatever is left is cut off and ctx's error returned. Shutting down
+// a node that isn't running does nothing
+func (c *Chord) Shutdown(ctx context.Context) error {
+	c.life.Lock()
+	switch c.state {
+	case Stopped, Stopping:
+		c.life.Unlock()
+		return nil
+	case Starting:
+		c.life.Unlock()
+		return errors.New("Shutdown: node is starting")
+	}
+	c.state = Stopping
+	c.life.Unlock()
+	n, s := c.Node, c.server
+	c.closeFrontEnds()
+	for _, suc := range n.successor {
+		if ctx.Err() != nil {
+			break
+		}
+		status := n.ping(suc)
+		if !status {
+			continue
+		}
+		err := n.migrateWhenQuiting(suc)
+		if err != nil {
+			continue
+		}
+		break
+	}
+	err := s.quit(ctx)
+	c.Node = nil
+	c.server = nil
+	c.setState(Stopped)
+	Magenta.Printf("%v Quit normally from %v\n", TimeClock(), n.IP)
+	return err
+}
+
+// shutdown stops s: the background loops finish their round, then the
+// calls in flight are served while new ones are refused, and then every
+// connection is closed. Whatever is still running once ctx is done is cut
+// off
+func (s *rpcServer) shutdown(ctx context.Context) error {
+	n := s.node
+	n.stop()
+	err := wait(ctx, n.tasks.close())
+	s.listener.Close()
+	drained := n.calls.close()
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.server.GracefulStop()
+		close(stopped)
+	}()
+	if err == nil {
+		err = wait(ctx, drained)
+	}
+	if err == nil {
+		err = wait(ctx, stopped)
+	}
+	s.grpc.stop()
+	<-s.accepted
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	if err == nil {
+		s.routes.Wait()
+	}
+	closeGRPC(n.IP)
+	n.bufferWriter.Flush()
+	n.file.Close()
+	return err
+}
+
+// closeGRPC closes the gRPC connections cached for the node at addr
+func closeGRPC(addr string) {
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	for key, conn := range grpcConns.m {
+		if strings.HasPrefix(key, addr + ">") {
+			conn.Close()
+			delete(grpcConns.m, key)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBusy exported
+// returned by a node that turned a call away; callers should back off
+var ErrBusy = errors.New("busy: node overloaded, retry later")
+
+// IsBusy exported
+func IsBusy(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "busy:")
+}
+
+// maintenance RPCs keep the ring together and are limited apart from data
+// RPCs, so that a flood of puts or lookups can't starve them; key transfers
+// count too, or a busy node could never take its range over
+var maintenance = map[string]bool {
+	"Node.Ping": true,
+	"Node.Notify": true,
+	"Node.GetPredecessor": true,
+	"Node.PassSuccessor": true,
+	"Node.MigrateWhenJoining": true,
+	"Node.Migrate": true,
+	"Node.MigrateBatch": true,
+}
+
+// Limits exported
+// token bucket rates in calls per second, with bursts of twice the rate;
+// Client bounds each client's data calls, Method each data method over all
+// clients, and Maintenance each client's maintenance calls
+type Limits struct {
+	Client, Method, Maintenance float64
+}
+
+type bucket struct {
+	tokens float64
+	last time.Time
+}
+
+func (b *bucket) take(rate float64, now time.Time) bool {
+	burst := 2 * rate
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type limiter struct {
+	limits Limits
+	lock sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newlimiter(limits Limits) *limiter {
+	return &limiter {
+		limits: limits,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *limiter) take(key string, rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) > 4096 {
+			for k, old := range l.buckets {
+				if now.Sub(old.last) > time.Minute {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+	return b.take(rate, now)
+}
+
+// admit decides whether client may call method now
+func (l *limiter) admit(client, method string) bool {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if maintenance[method] {
+		return l.take("maintenance|" + client, l.limits.Maintenance, now)
+	}
+	return l.take("client|" + client, l.limits.Client, now) && l.take("method|" + method, l.limits.Method, now)
+}
+
+// admit checks a call against n's limits, counting refusals
+func (n *Node) admit(client, method string) error {
+	limits := n.limits
+	if limits == nil || limits.admit(client, method) {
+		return nil
+	}
+	n.auth.reject("busy")
+	return ErrBusy
+}
+
+// clientOf names the caller behind addr; all connections from one host
+// share its limits
+func clientOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitCodec is net/rpc's gob server codec, turning away calls over the
+// node's limits, or made while it shuts down, before their arguments reach
+// the handler. It counts the calls in flight so that shutdown can wait for
+// them
+type limitCodec struct {
+	rwc io.ReadWriteCloser
+	dec *gob.Decoder
+	enc *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+	node *Node
+	client string
+	busy error
+}
+
+func newlimitCodec(conn net.Conn, n *Node) *limitCodec {
+	buf := bufio.NewWriter(conn)
+	return &limitCodec {
+		rwc: conn,
+		dec: gob.NewDecoder(conn),
+		enc: gob.NewEncoder(buf),
+		encBuf: buf,
+		node: n,
+		client: clientOf(conn.RemoteAddr()),
+	}
+}
+
+func (c *limitCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	if err == nil {
+		c.busy = c.node.admit(c.client, r.ServiceMethod)
+		if !c.node.calls.begin() {
+			c.busy = ErrStopping
+		}
+	}
+	return err
+}
+
+// ReadRequestBody fails for a refused call once its body is read, so that
+// net/rpc answers it with the busy error instead of running it
+func (c *limitCodec) ReadRequestBody(body interface{}) error {
+	err := c.dec.Decode(body)
+	if err == nil && c.busy != nil {
+		err = c.busy
+	}
+	c.busy = nil
+	return err
+}
+
+func (c *limitCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.node.calls.end()
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *limitCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// backoffClient retries calls a busy node turned away, waiting longer each
+// time, and gives the busy error back after a few tries
+type backoffClient struct {
+	rpcClient
+}
+
+func (c backoffClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	delay := 20 * time.Millisecond
+	for i := 0; ; i++ {
+		err := c.rpcClient.Call(serviceMethod, args, reply)
+		if !IsBusy(err) || i == 3 {
+			return err
+		}
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
@@ -0,0 +1,518 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LeaseExpired exported
+	LeaseExpired = "expired"
+	// LeaseMigrated exported
+	LeaseMigrated = "migration"
+	// leaseStale is how long a replica outlives the last refresh from its owner
+	leaseStale = 10 * time.Second
+)
+
+// Lease exported
+// a lock on Key held by Holder, reachable at Addr, until Expires; Token
+// rises with every new holder, whichever node owns Key, and is the fencing
+// token a holder hands to whatever the lock protects. A released lease
+// keeps its Token with no Holder
+type Lease struct {
+	Key, Holder, Addr string
+	Token uint64
+	Expires time.Time
+	// Version orders copies of the lease between its owner and replicas
+	Version uint64
+	Auth Auth
+}
+
+// LockArgs exported
+type LockArgs struct {
+	Key, Holder, Addr string
+	TTL time.Duration
+	Token uint64
+	Cred Cred
+}
+
+// body is what Cred signs besides the key
+func (args LockArgs) body() string {
+	return args.Holder + "|" + args.Addr + "|" + args.TTL.String() + "|" + strconv.FormatUint(args.Token, 10)
+}
+
+// LeaseLoss exported
+// tells a holder that the owner no longer grants it the lease
+type LeaseLoss struct {
+	Key, Holder, Reason string
+	Token uint64
+	Auth Auth
+}
+
+// Lock exported
+// a lease this node holds; Lost receives the reason once it is gone
+type Lock struct {
+	Key, Holder string
+	Token uint64
+	TTL time.Duration
+	Expires time.Time
+	Lost chan string
+}
+
+// leaseStore keeps the leases n owns or replicates, and the locks n holds
+type leaseStore struct {
+	lock sync.Mutex
+	leases map[string]Lease
+	seen map[string]time.Time
+	held map[string]*Lock
+}
+
+func (l Lease) held(now time.Time) bool {
+	return l.Holder != "" && now.Before(l.Expires)
+}
+
+// grant stores l as n's newest copy of its lease; a new holder gets the
+// fresh version as its token, which keeps tokens rising across owners since
+// versions do
+func (n *Node) grant(l Lease, fresh bool) Lease {
+	n.dataLock.Lock()
+	l.Version = n.nextVersion()
+	n.dataLock.Unlock()
+	if fresh {
+		l.Token = l.Version
+	}
+	l.Auth = Auth{}
+	n.leases.leases[l.Key] = l
+	n.leases.seen[l.Key] = time.Now()
+	return l
+}
+
+// Acquire exported
+// grants the lease on a free or expired key with the next fencing token;
+// the holder already holding it gets it extended instead
+func (n *Node) Acquire(args LockArgs, reply *Lease) error {
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermWrite, args.Key, args.body())
+	if err != nil {
+		return err
+	}
+	if args.Holder == "" || args.TTL <= 0 {
+		return errors.New("lock: expect a holder and a positive TTL")
+	}
+	now := time.Now()
+	n.leases.lock.Lock()
+	l := n.leases.leases[args.Key]
+	if l.held(now) && l.Holder != args.Holder {
+		n.leases.lock.Unlock()
+		return errors.New("lock: " + args.Key + " held by " + l.Holder)
+	}
+	fresh := !l.held(now)
+	l.Key, l.Holder, l.Addr = args.Key, args.Holder, args.Addr
+	l.Expires = now.Add(args.TTL)
+	l = n.grant(l, fresh)
+	n.leases.lock.Unlock()
+	n.replicateLease(l)
+	*reply = l
+	return nil
+}
+
+// check returns the lease on args.Key if args names its current holder
+func (n *Node) check(args LockArgs, now time.Time) (Lease, error) {
+	l, ok := n.leases.leases[args.Key]
+	if !ok || l.Holder != args.Holder || l.Token != args.Token {
+		return l, errors.New("lock: " + args.Key + " not held by " + args.Holder)
+	}
+	if !l.held(now) {
+		return l, errors.New("lock: lease on " + args.Key + " " + LeaseExpired)
+	}
+	return l, nil
+}
+
+// Renew exported
+func (n *Node) Renew(args LockArgs, reply *Lease) error {
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermWrite, args.Key, args.body())
+	if err != nil {
+		return err
+	}
+	if args.TTL <= 0 {
+		return errors.New("lock: expect a positive TTL")
+	}
+	now := time.Now()
+	n.leases.lock.Lock()
+	l, err := n.check(args, now)
+	if err != nil {
+		n.leases.lock.Unlock()
+		return err
+	}
+	l.Expires = now.Add(args.TTL)
+	l = n.grant(l, false)
+	n.leases.lock.Unlock()
+	n.replicateLease(l)
+	*reply = l
+	return nil
+}
+
+// Release exported
+func (n *Node) Release(args LockArgs, reply *Lease) error {
+	err := n.checkOwner(args.Key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermWrite, args.Key, args.body())
+	if err != nil {
+		return err
+	}
+	n.leases.lock.Lock()
+	l, err := n.check(args, time.Now())
+	if err != nil {
+		n.leases.lock.Unlock()
+		return err
+	}
+	l.Holder, l.Addr = "", ""
+	l.Expires = time.Time{}
+	l = n.grant(l, false)
+	n.leases.lock.Unlock()
+	n.replicateLease(l)
+	*reply = l
+	return nil
+}
+
+// ReplicateLease exported
+// stores a copy of a lease sent by its owner, or by the node handing it over
+func (n *Node) ReplicateLease(l Lease, reply *bool) error {
+	if !n.verify(l.Auth, "", "lease", l.Key) {
+		n.auth.reject("lease")
+		return errors.New("lock: replica not signed by a ring member")
+	}
+	l.Auth = Auth{}
+	n.dataLock.Lock()
+	n.observe(l.Version)
+	n.observe(l.Token)
+	n.dataLock.Unlock()
+	n.leases.lock.Lock()
+	defer n.leases.lock.Unlock()
+	cur, ok := n.leases.leases[l.Key]
+	*reply = !ok || l.Version >= cur.Version
+	if *reply {
+		n.leases.leases[l.Key] = l
+	}
+	n.leases.seen[l.Key] = time.Now()
+	return nil
+}
+
+// LeaseLost exported
+// delivered to a holder whose lease the owner took back
+func (n *Node) LeaseLost(loss LeaseLoss, reply *bool) error {
+	if !n.verify(loss.Auth, "", "lease", loss.Key) {
+		n.auth.reject("lease")
+		return errors.New("lock: loss not signed by a ring member")
+	}
+	*reply = n.lose(loss.Holder, loss.Token, loss.Reason)
+	return nil
+}
+
+// lose drops the lock held as holder with token, telling its user why
+func (n *Node) lose(holder string, token uint64, reason string) bool {
+	n.leases.lock.Lock()
+	defer n.leases.lock.Unlock()
+	lock, ok := n.leases.held[holder]
+	if !ok || lock.Token != token {
+		return false
+	}
+	delete(n.leases.held, holder)
+	Yellow.Printf("%v Lost lock on %v, token %v: %v\n", TimeClock(), lock.Key, token, reason)
+	select {
+	case lock.Lost <- reason:
+	default:
+	}
+	return true
+}
+
+// rpcReplicateLease copies l to addr and reports whether addr kept it over
+// a newer lease of its own
+func (n *Node) rpcReplicateLease(addr string, l Lease) (bool, error) {
+	client := n.dial(addr)
+	if client == nil {
+		return false, errors.New("lock: client offline")
+	}
+	defer client.Close()
+	l.Auth = n.sign("lease", l.Key)
+	var kept bool
+	err := client.Call("Node.ReplicateLease", l, &kept)
+	return kept, err
+}
+
+// replicateLease copies l to the successors that take over the key when n
+// fails
+func (n *Node) replicateLease(l Lease) {
+	for i := 0; i < 2; i++ {
+		addr := n.successor[i]
+		if addr == "" || addr == n.IP || i == 1 && addr == n.successor[0] {
+			continue
+		}
+		_, err := n.rpcReplicateLease(addr, l)
+		if err != nil {
+			Cyan.Println(TimeClock(), "replicate lease:", err, "to", addr)
+		}
+	}
+}
+
+// notifyLoss tells the holder of l that it lost the lease
+func (n *Node) notifyLoss(l Lease, reason string) {
+	if l.Addr == "" {
+		return
+	}
+	client := n.dial(l.Addr)
+	if client == nil {
+		Cyan.Println(TimeClock(), "lease lost: holder", l.Addr, "offline")
+		return
+	}
+	defer client.Close()
+	var reply bool
+	loss := LeaseLoss {
+		Key: l.Key,
+		Holder: l.Holder,
+		Reason: reason,
+		Token: l.Token,
+		Auth: n.sign("lease", l.Key),
+	}
+	err := client.Call("Node.LeaseLost", loss, &reply)
+	if err != nil {
+		Cyan.Println(TimeClock(), "lease lost:", err, "to", l.Addr)
+	}
+}
+
+// handOffLeases copies leases to addr, which takes over some of n's keys;
+// all of them go when n is leaving. A holder whose lease can't be handed
+// over is told it lost it, since the new owner won't renew it
+func (n *Node) handOffLeases(addr string, all bool) {
+	n.leases.lock.Lock()
+	var moving []Lease
+	for _, l := range n.leases.leases {
+		if all || !between(n.idOf(addr), hashString(l.Key), n.id, true) {
+			moving = append(moving, l)
+		}
+	}
+	n.leases.lock.Unlock()
+	now := time.Now()
+	for _, l := range moving {
+		kept, err := n.rpcReplicateLease(addr, l)
+		if kept {
+			Magenta.Printf("%v Hand off lease on %v to %v\n", TimeClock(), l.Key, addr)
+			continue
+		}
+		if err != nil {
+			Cyan.Println(TimeClock(), "hand off lease:", err, "to", addr)
+		} else {
+			Cyan.Println(TimeClock(), "hand off lease:", addr, "kept a newer lease on", l.Key)
+		}
+		if l.held(now) {
+			n.notifyLoss(l, LeaseMigrated)
+		}
+	}
+}
+
+// maintainLeasesPeriodically expires the leases n owns, telling their
+// holders, and keeps their replicas fresh on n's successors; replicas whose
+// owner stopped refreshing them are dropped. Locks n holds are given up
+// locally once they run out, whether or not the owner could say so
+func (n *Node) maintainLeasesPeriodically() {
+	period := time.NewTicker(time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		now := time.Now()
+		n.leases.lock.Lock()
+		var leases []Lease
+		for _, l := range n.leases.leases {
+			leases = append(leases, l)
+		}
+		var held []*Lock
+		for _, lock := range n.leases.held {
+			if !now.Before(lock.Expires) {
+				held = append(held, lock)
+			}
+		}
+		n.leases.lock.Unlock()
+		for _, lock := range held {
+			n.lose(lock.Holder, lock.Token, LeaseExpired)
+		}
+		for _, l := range leases {
+			owner, err := n.lookup(l.Key)
+			if err != nil {
+				continue
+			}
+			n.leases.lock.Lock()
+			cur, ok := n.leases.leases[l.Key]
+			if !ok || cur.Version != l.Version {
+				n.leases.lock.Unlock()
+				continue
+			}
+			if owner != n.IP {
+				if time.Since(n.leases.seen[l.Key]) > leaseStale {
+					delete(n.leases.leases, l.Key)
+					delete(n.leases.seen, l.Key)
+				}
+				n.leases.lock.Unlock()
+				continue
+			}
+			expired := l.Holder != "" && !l.held(now)
+			if expired {
+				cur.Holder, cur.Addr = "", ""
+				cur.Expires = time.Time{}
+				cur = n.grant(cur, false)
+			}
+			n.leases.seen[l.Key] = now
+			n.leases.lock.Unlock()
+			if expired {
+				Magenta.Printf("%v Lease on %v expired, token %v\n", TimeClock(), l.Key, l.Token)
+				n.notifyLoss(l, LeaseExpired)
+			}
+			n.replicateLease(cur)
+		}
+	}
+}
+
+// rpcLock sends a lock call for args.Key to its owner
+func (n *Node) rpcLock(method string, args LockArgs) (Lease, error) {
+	var reply Lease
+	args.Cred = n.credential(PermWrite, args.Key, args.body())
+	_, err := n.callOwner(args.Key, method, args, &reply)
+	return reply, err
+}
+
+// Acquire exported
+// takes the lock on key for ttl; it must be renewed before it runs out
+func (c *Chord) Acquire(key string, ttl time.Duration) (*Lock, error) {
+	if c.Node == nil {
+		return nil, errors.New("Lock: have not created or joined")
+	}
+	args := LockArgs {
+		Key: key,
+		Holder: fmt.Sprintf("%v#%v", c.Node.IP, time.Now().UnixNano()),
+		Addr: c.Node.IP,
+		TTL: ttl,
+	}
+	l, err := c.Node.rpcLock("Acquire", args)
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock {
+		Key: key,
+		Holder: args.Holder,
+		Token: l.Token,
+		TTL: ttl,
+		Expires: time.Now().Add(ttl),
+		Lost: make(chan string, 1),
+	}
+	c.Node.leases.lock.Lock()
+	c.Node.leases.held[lock.Holder] = lock
+	c.Node.leases.lock.Unlock()
+	return lock, nil
+}
+
+// Renew exported
+// extends lock by its TTL; a lock the owner no longer grants is lost
+func (c *Chord) Renew(lock *Lock) error {
+	if c.Node == nil {
+		return errors.New("Renew: have not created or joined")
+	}
+	start := time.Now()
+	_, err := c.Node.rpcLock("Renew", LockArgs{Key: lock.Key, Holder: lock.Holder, Token: lock.Token, TTL: lock.TTL})
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "lock: ") {
+			c.Node.lose(lock.Holder, lock.Token, err.Error())
+		}
+		return err
+	}
+	c.Node.leases.lock.Lock()
+	lock.Expires = start.Add(lock.TTL)
+	c.Node.leases.lock.Unlock()
+	return nil
+}
+
+// Release exported
+func (c *Chord) Release(lock *Lock) error {
+	if c.Node == nil {
+		return errors.New("Release: have not created or joined")
+	}
+	c.Node.leases.lock.Lock()
+	delete(c.Node.leases.held, lock.Holder)
+	c.Node.leases.lock.Unlock()
+	_, err := c.Node.rpcLock("Release", LockArgs{Key: lock.Key, Holder: lock.Holder, Token: lock.Token})
+	return err
+}
+
+// heldLock finds the lock this node holds on key
+func (c *Chord) heldLock(key string) *Lock {
+	c.Node.leases.lock.Lock()
+	defer c.Node.leases.lock.Unlock()
+	for _, lock := range c.Node.leases.held {
+		if lock.Key == key {
+			return lock
+		}
+	}
+	return nil
+}
+
+// LockCmd exported
+// lock <key> <ttl-seconds>
+func (c *Chord) LockCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Lock: expect key and TTL in seconds")
+	}
+	secs, err := strconv.Atoi(args[1])
+	if err != nil || secs <= 0 {
+		return errors.New("Lock: expect TTL in seconds")
+	}
+	lock, err := c.Acquire(args[0], time.Duration(secs) * time.Second)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Locked %v for %vs, token %v\n", TimeClock(), lock.Key, secs, lock.Token)
+	return nil
+}
+
+// RenewCmd exported
+func (c *Chord) RenewCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Renew: expect key")
+	}
+	lock := c.heldLock(args[0])
+	if lock == nil {
+		return errors.New("Renew: " + args[0] + " not locked here")
+	}
+	err := c.Renew(lock)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Renewed %v for %v, token %v\n", TimeClock(), lock.Key, lock.TTL, lock.Token)
+	return nil
+}
+
+// UnlockCmd exported
+func (c *Chord) UnlockCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Unlock: expect key")
+	}
+	lock := c.heldLock(args[0])
+	if lock == nil {
+		return errors.New("Unlock: " + args[0] + " not locked here")
+	}
+	err := c.Release(lock)
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Unlocked %v, token %v\n", TimeClock(), lock.Key, lock.Token)
+	return nil
+}
@@ -0,0 +1,382 @@
+package dht
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxItemSize is the largest value the text protocol and the HTTP API take,
+// memcached's default
+const maxItemSize = 1024 * 1024
+
+const (
+	// StoreSet exported
+	StoreSet = "set"
+	// StoreAdd exported
+	StoreAdd = "add"
+	// StoreCas exported
+	StoreCas = "cas"
+	// StoreIncr exported
+	StoreIncr = "incr"
+)
+
+// Item exported
+// a missing key is reported with Version 0
+type Item struct {
+	Key, Val string
+	Flags uint32
+	Version uint64
+}
+
+// StoreArgs exported
+type StoreArgs struct {
+	Op string
+	Item Item
+	TTL time.Duration
+	Delta uint64
+	Cred Cred
+}
+
+// body is what Cred signs besides the key
+func (args StoreArgs) body() string {
+	return args.Op + "|" + args.Item.Val + "|" + strconv.FormatUint(uint64(args.Item.Flags), 10) + "|" +
+		strconv.FormatUint(args.Item.Version, 10) + "|" + args.TTL.String() + "|" + strconv.FormatUint(args.Delta, 10)
+}
+
+// StoreReply exported
+type StoreReply struct {
+	Status string
+	Item Item
+}
+
+// Lookup exported
+func (n *Node) Lookup(args KeyArgs, item *Item) error {
+	key := args.Key
+	err := n.checkOwner(key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermRead, key, "")
+	if err != nil {
+		return err
+	}
+	n.expire(key)
+	item.Key = key
+	n.dataLock.Lock()
+	if val, ok := n.data[key]; ok {
+		item.Val, item.Flags, item.Version = val, n.flags[key], n.version[key]
+	}
+	n.dataLock.Unlock()
+	return nil
+}
+
+// Store exported
+// applies conditional writes atomically at the owner of the key
+func (n *Node) Store(args StoreArgs, reply *StoreReply) error {
+	key := args.Item.Key
+	err := n.checkOwner(key)
+	if err != nil {
+		return err
+	}
+	err = n.allow(args.Cred, PermWrite, key, args.body())
+	if err != nil {
+		return err
+	}
+	n.dataLock.Lock()
+	expired := n.expireLocked(key)
+	stored, err := n.storeLocked(args, reply)
+	n.dataLock.Unlock()
+	if expired {
+		n.invalidate(key)
+		n.publish(EventDelete, key, "")
+	}
+	if stored {
+		n.invalidate(key)
+		n.publish(EventPut, key, reply.Item.Val)
+	}
+	return err
+}
+
+// storeLocked applies args, reporting whether it wrote; callers hold
+// dataLock
+func (n *Node) storeLocked(args StoreArgs, reply *StoreReply) (bool, error) {
+	key := args.Item.Key
+	_, exists := n.data[key]
+	putArgs := PutArgs {
+		Key: key,
+		Val: args.Item.Val,
+		Flags: args.Item.Flags,
+	}
+	switch args.Op {
+	case StoreSet:
+	case StoreAdd:
+		if exists {
+			reply.Status = "NOT_STORED"
+			return false, nil
+		}
+	case StoreCas:
+		if !exists {
+			reply.Status = "NOT_FOUND"
+			return false, nil
+		}
+		if n.version[key] != args.Item.Version {
+			reply.Status = "EXISTS"
+			return false, nil
+		}
+	case StoreIncr:
+		if !exists {
+			reply.Status = "NOT_FOUND"
+			return false, nil
+		}
+		val, err := strconv.ParseUint(n.data[key], 10, 64)
+		if err != nil {
+			return false, errors.New("cannot increment or decrement non-numeric value")
+		}
+		putArgs.Val = strconv.FormatUint(val + args.Delta, 10)
+		putArgs.Flags = n.flags[key]
+		args.TTL = n.ttl(key)
+	default:
+		return false, errors.New("store: unknown operation " + args.Op)
+	}
+	// the ACL takes the admin's signature and a newer serial, as on Put
+	if n.acl != nil && key == aclKey {
+		err := n.acl.admit(putArgs.Val, false)
+		if err != nil {
+			return false, err
+		}
+	}
+	delete(n.expiry, key)
+	n.saveLocked(putArgs)
+	if args.TTL > 0 {
+		n.expiry[key] = time.Now().Add(args.TTL)
+	}
+	reply.Status = "STORED"
+	reply.Item = Item {
+		Key: key,
+		Val: putArgs.Val,
+		Flags: putArgs.Flags,
+		Version: n.version[key],
+	}
+	return true, nil
+}
+
+// lookupItem reads key with its flags and version from its owner
+func (n *Node) lookupItem(key string) (Item, error) {
+	var item Item
+	_, err := n.callOwner(key, "Lookup", KeyArgs{Key: key, Cred: n.credential(PermRead, key, "")}, &item)
+	return item, err
+}
+
+// storeItem applies args at the owner of its key
+func (n *Node) storeItem(args StoreArgs) (StoreReply, error) {
+	var reply StoreReply
+	args.Cred = n.credential(PermWrite, args.Item.Key, args.body())
+	_, err := n.callOwner(args.Item.Key, "Store", args, &reply)
+	return reply, err
+}
+
+// memcacheServer speaks the memcached text protocol on top of the ring
+type memcacheServer struct {
+	node     *Node
+	addr     string
+	listener net.Listener
+}
+
+func newmemcacheServer(n *Node, port string) *memcacheServer {
+	return &memcacheServer{
+		node: n,
+		addr: withPort(n.IP, port),
+	}
+}
+
+func (s *memcacheServer) listen() error {
+	l, err := s.node.listen(s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go s.accept()
+	return nil
+}
+
+func (s *memcacheServer) quit() {
+	s.listener.Close()
+}
+
+func (s *memcacheServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *memcacheServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" {
+			return
+		}
+		err = s.exec(r, w, args)
+		w.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// memcacheTTL converts a memcached exptime, which is relative seconds up to
+// 30 days and a unix timestamp beyond that
+func memcacheTTL(exptime int64) time.Duration {
+	if exptime == 0 {
+		return 0
+	}
+	if exptime > 60 * 60 * 24 * 30 {
+		return time.Until(time.Unix(exptime, 0))
+	}
+	return time.Duration(exptime) * time.Second
+}
+
+func (s *memcacheServer) exec(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	noreply := args[0] != "get" && args[0] != "gets" && args[len(args) - 1] == "noreply"
+	if noreply {
+		args = args[:len(args) - 1]
+	}
+	if len(args) == 0 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	respond := func(msg string) {
+		if !noreply {
+			w.WriteString(msg + "\r\n")
+		}
+	}
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		for _, key := range args[1:] {
+			item, err := s.node.lookupItem(key)
+			if err != nil {
+				w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+				return nil
+			}
+			if item.Version == 0 {
+				continue
+			}
+			w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(item.Flags), 10) + " " + strconv.Itoa(len(item.Val)))
+			if args[0] == "gets" {
+				w.WriteString(" " + strconv.FormatUint(item.Version, 10))
+			}
+			w.WriteString("\r\n" + item.Val + "\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set", "add", "cas":
+		if (args[0] == "cas" && len(args) != 6) || (args[0] != "cas" && len(args) != 5) {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		flags, err1 := strconv.ParseUint(args[2], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[3], 10, 64)
+		size, err3 := strconv.Atoi(args[4])
+		if err1 != nil || err2 != nil || err3 != nil {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		// the data block of a size out of range can't be skipped safely,
+		// so the connection is closed instead of read into memory
+		if size < 0 || size > maxItemSize {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return errors.New("memcache: bad data chunk")
+		}
+		buf := make([]byte, size + 2)
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		if string(buf[size:]) != "\r\n" {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+		storeArgs := StoreArgs {
+			Op: args[0],
+			Item: Item {
+				Key: args[1],
+				Val: string(buf[:size]),
+				Flags: uint32(flags),
+			},
+			TTL: memcacheTTL(exptime),
+		}
+		if args[0] == "cas" {
+			storeArgs.Item.Version, err = strconv.ParseUint(args[5], 10, 64)
+			if err != nil {
+				w.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return nil
+			}
+		}
+		if exptime < 0 {
+			storeArgs.TTL = time.Nanosecond
+		}
+		reply, err := s.node.storeItem(storeArgs)
+		if err != nil {
+			respond("SERVER_ERROR " + err.Error())
+			return nil
+		}
+		respond(reply.Status)
+	case "delete":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		ok, err := s.node.rpcDelete(s.node.find(args[1]), args[1])
+		if err != nil {
+			respond("SERVER_ERROR " + err.Error())
+		} else if ok {
+			respond("DELETED")
+		} else {
+			respond("NOT_FOUND")
+		}
+	case "incr":
+		if len(args) != 3 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+		reply, err := s.node.storeItem(StoreArgs{Op: StoreIncr, Item: Item{Key: args[1]}, Delta: delta})
+		if err != nil {
+			respond("CLIENT_ERROR " + err.Error())
+		} else if reply.Status != "STORED" {
+			respond(reply.Status)
+		} else {
+			respond(reply.Item.Val)
+		}
+	case "version":
+		w.WriteString("VERSION dht-chord\r\n")
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
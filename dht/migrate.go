@@ -0,0 +1,277 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// migrateBatch and migrateBytes bound one batch of a transfer
+	migrateBatch = 64
+	migrateBytes = 1 << 20
+	// migrateRetries is how often a transfer resumes after failing in a row
+	migrateRetries = 5
+)
+
+// MigrateItem exported
+// one key of a transfer, with the time it has left to live
+type MigrateItem struct {
+	Key, Val string
+	Flags uint32
+	Version uint64
+	TTL time.Duration
+}
+
+// MigrateBatchArgs exported
+type MigrateBatchArgs struct {
+	Transfer string
+	Seq int
+	Items []MigrateItem
+	Auth Auth
+}
+
+// Transfer exported
+// progress of a transfer of keys to Dest; Checkpoint is the hash of the
+// last key Dest acknowledged, and a resumed transfer starts after it
+type Transfer struct {
+	ID, Dest, Checkpoint string
+	Total, Moved, Batches, Retries int
+	Done bool
+	Err string
+}
+
+type transferLog struct {
+	lock sync.Mutex
+	transfers map[string]*Transfer
+}
+
+func (l *transferLog) update(t *Transfer) {
+	l.lock.Lock()
+	copied := *t
+	l.transfers[t.Dest] = &copied
+	l.lock.Unlock()
+}
+
+func (l *transferLog) snapshot() []Transfer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var all []Transfer
+	for _, t := range l.transfers {
+		all = append(all, *t)
+	}
+	return all
+}
+
+// MigrateBatch exported
+// stores a batch of keys handed over by a neighbour; resent batches are
+// harmless since a newer copy already held wins
+func (n *Node) MigrateBatch(args MigrateBatchArgs, reply *int) error {
+	err := n.allowNode(args.Auth, "migrate", args.Transfer, strconv.Itoa(args.Seq))
+	if err != nil {
+		return err
+	}
+	var saved []string
+	n.dataLock.Lock()
+	for _, item := range args.Items {
+		if version, ok := n.version[item.Key]; ok && version > item.Version {
+			continue
+		}
+		if n.acl != nil && item.Key == aclKey {
+			err = n.acl.admit(item.Val, true)
+			if err != nil {
+				break
+			}
+		}
+		n.saveLocked(PutArgs{Key: item.Key, Val: item.Val, Flags: item.Flags, Version: item.Version})
+		delete(n.expiry, item.Key)
+		if item.TTL > 0 {
+			n.expiry[item.Key] = time.Now().Add(item.TTL)
+		}
+		saved = append(saved, item.Key)
+	}
+	n.dataLock.Unlock()
+	for _, key := range saved {
+		n.invalidate(key)
+	}
+	if err != nil {
+		return err
+	}
+	*reply = args.Seq
+	return nil
+}
+
+// pending lists the keys n still has to hand over, ordered by hash and
+// starting after the checkpoint
+func (n *Node) pending(moving func(id *big.Int) bool, checkpoint *big.Int) []string {
+	type hashed struct {
+		key string
+		id *big.Int
+	}
+	var keys []hashed
+	n.dataLock.Lock()
+	for k := range n.data {
+		id := hashString(k)
+		if moving(id) && (checkpoint == nil || id.Cmp(checkpoint) > 0) {
+			keys = append(keys, hashed{k, id})
+		}
+	}
+	n.dataLock.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].id.Cmp(keys[j].id) < 0
+	})
+	pending := make([]string, len(keys))
+	for i, k := range keys {
+		pending[i] = k.key
+	}
+	return pending
+}
+
+// transfer streams the keys moving to addr in batches, dropping each batch
+// locally only once addr acknowledged it; keys written again meanwhile stay
+// and are forwarded later as strays. After a failure it resumes from the
+// last checkpoint, and gives up leaving the rest in place after
+// migrateRetries failures in a row
+func (n *Node) transfer(addr string, moving func(id *big.Int) bool) error {
+	t := &Transfer {
+		ID: fmt.Sprintf("%v#%v", n.IP, time.Now().UnixNano()),
+		Dest: addr,
+	}
+	var checkpoint *big.Int
+	t.Total = len(n.pending(moving, nil))
+	failures := 0
+	for {
+		keys := n.pending(moving, checkpoint)
+		if len(keys) == 0 {
+			break
+		}
+		err := n.sendBatches(addr, keys, t, &checkpoint)
+		if err == nil {
+			continue
+		}
+		failures++
+		t.Retries++
+		t.Err = err.Error()
+		n.transfers.update(t)
+		Cyan.Printf("%v Migrate to %v: %v, %v of %v keys moved\n", TimeClock(), addr, err, t.Moved, t.Total)
+		if failures >= migrateRetries {
+			return errors.New("migrate: gave up on " + addr + ": " + err.Error())
+		}
+		time.Sleep(time.Duration(100 << uint(failures)) * time.Millisecond)
+	}
+	t.Done = true
+	t.Err = ""
+	if t.Total > 0 {
+		n.transfers.update(t)
+		Magenta.Printf("%v Migrated %v keys to %v in %v batches\n", TimeClock(), t.Moved, addr, t.Batches)
+	}
+	return nil
+}
+
+// sendBatches sends keys to addr over one connection, advancing the
+// checkpoint with every acknowledged batch
+func (n *Node) sendBatches(addr string, keys []string, t *Transfer, checkpoint **big.Int) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("migrate: client offline")
+	}
+	defer client.Close()
+	for len(keys) > 0 {
+		var items []MigrateItem
+		size := 0
+		n.dataLock.Lock()
+		for len(keys) > 0 && len(items) < migrateBatch && size < migrateBytes {
+			k := keys[0]
+			keys = keys[1:]
+			val, ok := n.data[k]
+			if !ok {
+				continue
+			}
+			items = append(items, MigrateItem {
+				Key: k,
+				Val: val,
+				Flags: n.flags[k],
+				Version: n.version[k],
+				TTL: n.ttl(k),
+			})
+			size += len(k) + len(val)
+		}
+		n.dataLock.Unlock()
+		if len(items) == 0 {
+			continue
+		}
+		t.Batches++
+		args := MigrateBatchArgs {
+			Transfer: t.ID,
+			Seq: t.Batches,
+			Items: items,
+			Auth: n.sign("migrate", t.ID, strconv.Itoa(t.Batches)),
+		}
+		var ack int
+		err := client.Call("Node.MigrateBatch", args, &ack)
+		if isUnimplemented(err) {
+			ack = args.Seq
+			err = n.migrateEach(client, items)
+		}
+		if err != nil {
+			return err
+		}
+		if ack != args.Seq {
+			return errors.New("migrate: batch " + strconv.Itoa(args.Seq) + " not acknowledged")
+		}
+		var dropped []string
+		n.dataLock.Lock()
+		for _, item := range items {
+			if n.version[item.Key] == item.Version && n.deleteLocked(item.Key) {
+				dropped = append(dropped, item.Key)
+			}
+		}
+		n.dataLock.Unlock()
+		for _, key := range dropped {
+			n.invalidate(key)
+		}
+		last := items[len(items) - 1].Key
+		*checkpoint = hashString(last)
+		t.Moved += len(items)
+		t.Checkpoint = (*checkpoint).Text(16)
+		n.transfers.update(t)
+		Magenta.Printf("%v Migrate to %v: batch %v, %v of %v keys\n", TimeClock(), addr, t.Batches, t.Moved, t.Total)
+	}
+	return nil
+}
+
+// migrateEach hands items over one Migrate at a time, for receivers that
+// don't implement MigrateBatch
+func (n *Node) migrateEach(client rpcClient, items []MigrateItem) error {
+	for _, item := range items {
+		args := PutArgs {
+			Key: item.Key,
+			Val: item.Val,
+			Flags: item.Flags,
+			Version: item.Version,
+			Auth: n.sign("migrate", item.Key),
+		}
+		var reply bool
+		err := client.Call("Node.Migrate", args, &reply)
+		if err != nil {
+			return err
+		}
+		if item.TTL > 0 {
+			client.Call("Node.Expire", ExpireArgs{Key: item.Key, TTL: item.TTL, Auth: n.sign("expire", item.Key)}, &reply)
+		}
+	}
+	return nil
+}
+
+// Transfers exported
+// the latest transfer to each node this node handed keys to
+func (c *Chord) Transfers() []Transfer {
+	if c.Node == nil {
+		return nil
+	}
+	return c.Node.transfers.snapshot()
+}
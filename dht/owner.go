@@ -0,0 +1,186 @@
+package dht
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// maxRedirects bounds how many not-owner redirects a call follows
+const maxRedirects = 8
+
+// NotOwner exported
+// a node's refusal of a key outside its range (Predecessor, Self], naming
+// the node it believes is closer to the owner
+type NotOwner struct {
+	Key, Try, Predecessor, Self, Successor string
+}
+
+func (e *NotOwner) Error() string {
+	return "not owner: try " + e.Try + " (range " + e.Predecessor + ".." + e.Self + ", successor " + e.Successor + ") for " + e.Key
+}
+
+// AsNotOwner exported
+// recovers the redirect from err, which is plain text once it crossed the
+// network
+func AsNotOwner(err error) (*NotOwner, bool) {
+	if err == nil {
+		return nil, false
+	}
+	if e, ok := err.(*NotOwner); ok {
+		return e, true
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "not owner: try ") {
+		return nil, false
+	}
+	e := &NotOwner{}
+	var ok bool
+	msg = msg[len("not owner: try "):]
+	e.Try, msg, ok = cut(msg, " (range ")
+	if !ok {
+		return nil, false
+	}
+	e.Predecessor, msg, ok = cut(msg, "..")
+	if !ok {
+		return nil, false
+	}
+	e.Self, msg, ok = cut(msg, ", successor ")
+	if !ok {
+		return nil, false
+	}
+	e.Successor, e.Key, ok = cut(msg, ") for ")
+	if !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+// IsNotOwner exported
+func IsNotOwner(err error) bool {
+	_, ok := AsNotOwner(err)
+	return ok
+}
+
+func cut(s, sep string) (string, string, bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i + len(sep):], true
+}
+
+func isOffline(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), ": client offline")
+}
+
+// owns tells whether key falls in (predecessor, n]; without a predecessor
+// n can't tell and assumes so, and while moving it owns nothing
+func (n *Node) owns(key string) bool {
+	if n.moving != "" {
+		return false
+	}
+	if n.predecessor == "" {
+		return true
+	}
+	return between(n.idOf(n.predecessor), hashString(key), n.id, true)
+}
+
+// checkOwner refuses a key n doesn't own, pointing at the owner n finds
+// for it, or at its predecessor when it finds none
+func (n *Node) checkOwner(key string) error {
+	if n.owns(key) {
+		return nil
+	}
+	if n.moving != "" {
+		return &NotOwner {
+			Key: key,
+			Try: n.moving,
+			Self: n.IP,
+		}
+	}
+	var owner Address
+	n.FindSuccessor(hashString(key), &owner)
+	try := owner.Addr
+	if try == "" || try == n.IP {
+		try = n.predecessor
+	}
+	return &NotOwner {
+		Key: key,
+		Try: try,
+		Predecessor: n.predecessor,
+		Self: n.IP,
+		Successor: n.successor[0],
+	}
+}
+
+// callAt calls method about key on addr, following the redirects of nodes
+// that don't own it, and returns the node that answered
+func (n *Node) callAt(addr, key, method string, args, reply interface{}) (string, error) {
+	for i := 0; ; i++ {
+		client := n.dial(addr)
+		if client == nil {
+			return addr, errors.New(strings.ToLower(method) + ": client offline")
+		}
+		err := client.Call("Node." + method, args, reply)
+		client.Close()
+		redirect, ok := AsNotOwner(err)
+		if !ok || i == maxRedirects || redirect.Try == "" {
+			return addr, err
+		}
+		n.cache.forget(addr)
+		n.cache.learn(n, redirect.Predecessor, redirect.Self)
+		Cyan.Println(TimeClock(), method + ": redirected from", addr, "to", redirect.Try, "for", key)
+		addr = redirect.Try
+	}
+}
+
+// forwardStrayKeysPeriodically hands keys n holds but doesn't own, left
+// behind by writes that raced a join, to their owner
+func (n *Node) forwardStrayKeysPeriodically() {
+	period := time.NewTicker(5 * time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		if n.moving != "" {
+			continue
+		}
+		var stray []string
+		n.dataLock.Lock()
+		for k := range n.data {
+			if !n.owns(k) {
+				stray = append(stray, k)
+			}
+		}
+		n.dataLock.Unlock()
+		for _, k := range stray {
+			owner, err := n.lookup(k)
+			if err != nil || owner == "" || owner == n.IP {
+				continue
+			}
+			client := n.dial(owner)
+			if client == nil {
+				continue
+			}
+			var reply bool
+			n.dataLock.Lock()
+			ttl := n.ttl(k)
+			n.dataLock.Unlock()
+			args := n.putArgs(k)
+			err = client.Call("Node.Migrate", args, &reply)
+			if err == nil {
+				if ttl > 0 {
+					client.Call("Node.Expire", ExpireArgs{Key: k, TTL: ttl, Auth: n.sign("expire", k)}, &reply)
+				}
+				// a write that came in meanwhile stays and is forwarded next time
+				n.dataLock.Lock()
+				dropped := n.version[k] == args.Version && n.deleteLocked(k)
+				n.dataLock.Unlock()
+				if dropped {
+					n.invalidate(k)
+				}
+				Magenta.Printf("%v Forward stray key %v to %v\n", TimeClock(), k, owner)
+			}
+			client.Close()
+		}
+	}
+}
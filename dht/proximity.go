@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// rttFresh is how long a measured round trip time is trusted
+	rttFresh = 30 * time.Second
+	// routeChoices is how many of the fingers making the most progress
+	// proximity routing picks the nearest from
+	routeChoices = 3
+)
+
+type rttSample struct {
+	rtt time.Duration
+	at time.Time
+}
+
+// rttTable keeps a smoothed round trip time to every node n talked to
+type rttTable struct {
+	lock sync.Mutex
+	samples map[string]rttSample
+}
+
+func (t *rttTable) observe(addr string, rtt time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s, ok := t.samples[addr]; ok {
+		rtt = (3 * s.rtt + rtt) / 4
+	}
+	t.samples[addr] = rttSample{rtt: rtt, at: time.Now()}
+}
+
+func (t *rttTable) get(addr string) (time.Duration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.samples[addr]
+	if !ok || time.Since(s.at) > rttFresh {
+		return 0, false
+	}
+	return s.rtt, true
+}
+
+func (t *rttTable) forget(addr string) {
+	t.lock.Lock()
+	delete(t.samples, addr)
+	t.lock.Unlock()
+}
+
+// probe pings addr, recording how long it took
+func (n *Node) probe(addr string) bool {
+	start := time.Now()
+	if !n.ping(addr) {
+		n.rtt.forget(addr)
+		return false
+	}
+	n.rtt.observe(addr, time.Since(start))
+	return true
+}
+
+// latency is the round trip time to addr, measured unless a fresh one is
+// known; ok is false when addr doesn't answer
+func (n *Node) latency(addr string) (time.Duration, bool) {
+	if rtt, ok := n.rtt.get(addr); ok {
+		return rtt, true
+	}
+	if !n.probe(addr) {
+		return 0, false
+	}
+	return n.rtt.get(addr)
+}
+
+// nearest returns the candidate with the lowest latency, or "" when none
+// answers
+func (n *Node) nearest(candidates []string) string {
+	best := ""
+	var bestRTT time.Duration
+	for _, addr := range candidates {
+		rtt, ok := n.latency(addr)
+		if ok && (best == "" || rtt < bestRTT) {
+			best, bestRTT = addr, rtt
+		}
+	}
+	return best
+}
+
+// proximateFinger picks finger i among the nodes in its interval
+// [n + 2^(i-1), n + 2^i): any of them routes correctly, so the exact
+// successor and the nodes on its successor list that still fall inside
+// compete on latency
+func (n *Node) proximateFinger(i int, exact string) string {
+	if exact == "" {
+		return exact
+	}
+	start := jump(n.id, i)
+	end := n.id
+	if i < keySize {
+		end = jump(n.id, i + 1)
+	}
+	inside := func(addr string) bool {
+		id := n.idOf(addr)
+		return id.Cmp(start) == 0 || between(start, id, end, false)
+	}
+	if !inside(exact) {
+		return exact
+	}
+	candidates := []string{exact}
+	client := n.dial(exact)
+	if client != nil {
+		for j := 0; j < 3; j++ {
+			var suc string
+			err := client.Call("Node.PassSuccessor", j, &suc)
+			if err != nil || suc == "" || suc == n.IP || !inside(suc) {
+				break
+			}
+			candidates = append(candidates, suc)
+		}
+		client.Close()
+	}
+	if best := n.nearest(candidates); best != "" {
+		return best
+	}
+	return exact
+}
+
+// proximateRoute is closestPrecedingNode choosing, among the few live
+// fingers and successors that get closest to id, the one with the lowest
+// latency
+func (n *Node) proximateRoute(id *big.Int) string {
+	seen := make(map[string]bool)
+	var candidates []string
+	consider := func(addr string) {
+		if len(candidates) >= routeChoices || addr == "" || seen[addr] {
+			return
+		}
+		seen[addr] = true
+		if between(n.id, n.idOf(addr), id, false) && n.probe(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	for i := keySize; i > 0; i-- {
+		consider(n.finger[i])
+	}
+	for i := 2; i >= 0; i-- {
+		consider(n.successor[i])
+	}
+	return n.nearest(candidates)
+}
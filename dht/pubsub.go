@@ -0,0 +1,384 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topicPrefix turns a topic name into the key whose owner is its
+// rendezvous node
+const topicPrefix = "topic/"
+
+// SubscribeArgs exported
+type SubscribeArgs struct {
+	Topic, ID, Addr string
+	// Seq carries the topic's message count along with a hand-off
+	Seq uint64
+	// Cred signs subscriptions by the subscriber, Auth hand-offs between
+	// rendezvous nodes
+	Cred Cred
+	Auth Auth
+}
+
+// PublishArgs exported
+type PublishArgs struct {
+	Topic, From, Data string
+	Cred Cred
+}
+
+// Message exported
+// Seq counts the messages the rendezvous node has fanned out on Topic; Auth
+// signs its delivery and is cleared before the subscriber sees it
+type Message struct {
+	Topic, ID, From, Data string
+	Seq uint64
+	Auth Auth
+}
+
+// Subscription exported
+type Subscription struct {
+	ID, Topic string
+	Messages chan Message
+}
+
+// topicStore keeps the subscribers of the topics n is rendezvous for, and
+// the subscriptions n made itself
+type topicStore struct {
+	lock sync.Mutex
+	subscribers map[string]map[string]string
+	seq map[string]uint64
+	subscribed map[string]*Subscription
+}
+
+func topicKey(topic string) string {
+	return topicPrefix + topic
+}
+
+// Subscribe exported
+func (n *Node) Subscribe(args SubscribeArgs, fresh *bool) error {
+	if n.allowNode(args.Auth, "subscribe", args.ID) != nil {
+		err := n.allow(args.Cred, PermRead, topicKey(args.Topic), "")
+		if err != nil {
+			return err
+		}
+	}
+	n.topics.lock.Lock()
+	defer n.topics.lock.Unlock()
+	subs, ok := n.topics.subscribers[args.Topic]
+	if !ok {
+		subs = make(map[string]string)
+		n.topics.subscribers[args.Topic] = subs
+	}
+	_, ok = subs[args.ID]
+	subs[args.ID] = args.Addr
+	if args.Seq > n.topics.seq[args.Topic] {
+		n.topics.seq[args.Topic] = args.Seq
+	}
+	*fresh = !ok
+	return nil
+}
+
+// Unsubscribe exported
+func (n *Node) Unsubscribe(args SubscribeArgs, reply *bool) error {
+	if n.allowNode(args.Auth, "unsubscribe", args.ID) != nil {
+		err := n.allow(args.Cred, PermRead, topicKey(args.Topic), "")
+		if err != nil {
+			return err
+		}
+	}
+	*reply = n.dropSubscriber(args.Topic, args.ID)
+	return nil
+}
+
+// dropSubscriber forgets subscriber id of topic and reports whether n knew it
+func (n *Node) dropSubscriber(topic, id string) bool {
+	n.topics.lock.Lock()
+	defer n.topics.lock.Unlock()
+	subs := n.topics.subscribers[topic]
+	_, ok := subs[id]
+	delete(subs, id)
+	if len(subs) == 0 {
+		delete(n.topics.subscribers, topic)
+	}
+	return ok
+}
+
+// Publish exported
+// fans a message out to every subscriber of the topic and answers with how
+// many received it; subscribers that can't be reached are dropped
+func (n *Node) Publish(args PublishArgs, delivered *int) error {
+	err := n.allow(args.Cred, PermWrite, topicKey(args.Topic), args.Data)
+	if err != nil {
+		return err
+	}
+	n.topics.lock.Lock()
+	n.topics.seq[args.Topic]++
+	seq := n.topics.seq[args.Topic]
+	subs := make(map[string]string)
+	for id, addr := range n.topics.subscribers[args.Topic] {
+		subs[id] = addr
+	}
+	n.topics.lock.Unlock()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for id, addr := range subs {
+		wg.Add(1)
+		go func(id, addr string) {
+			defer wg.Done()
+			msg := Message {
+				Topic: args.Topic,
+				ID: id,
+				From: args.From,
+				Data: args.Data,
+				Seq: seq,
+			}
+			err := n.rpcReceive(addr, msg)
+			if err != nil {
+				Cyan.Println(TimeClock(), "publish:", err, "to", addr, "dropping", id)
+				n.dropSubscriber(args.Topic, id)
+				return
+			}
+			lock.Lock()
+			*delivered++
+			lock.Unlock()
+		}(id, addr)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Receive exported
+// hands a published message to the local subscription it is meant for; only
+// the rendezvous node, a ring member, delivers messages
+func (n *Node) Receive(msg Message, reply *bool) error {
+	err := n.allowNode(msg.Auth, "receive", msg.ID, msg.Topic)
+	if err != nil {
+		return err
+	}
+	msg.Auth = Auth{}
+	n.topics.lock.Lock()
+	defer n.topics.lock.Unlock()
+	sub, ok := n.topics.subscribed[msg.ID]
+	if !ok {
+		return errors.New("receive: subscription not found")
+	}
+	select {
+	case sub.Messages <- msg:
+	default:
+		Yellow.Println(TimeClock(), "receive: queue full, dropping message", msg.Seq, "on", msg.Topic)
+	}
+	*reply = true
+	return nil
+}
+
+func (n *Node) rpcReceive(addr string, msg Message) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("receive: client offline")
+	}
+	defer client.Close()
+	msg.Auth = n.sign("receive", msg.ID, msg.Topic)
+	var reply bool
+	return client.Call("Node.Receive", msg, &reply)
+}
+
+// handOffTopics passes the subscribers of topics moving to addr along with
+// their keys; all of them go when n is leaving
+func (n *Node) handOffTopics(addr string, all bool) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("hand off topics: client offline")
+	}
+	defer client.Close()
+	n.topics.lock.Lock()
+	var moving []SubscribeArgs
+	for topic, subs := range n.topics.subscribers {
+		if !all && between(n.idOf(addr), hashString(topicKey(topic)), n.id, true) {
+			continue
+		}
+		for id, sub := range subs {
+			moving = append(moving, SubscribeArgs{Topic: topic, ID: id, Addr: sub, Seq: n.topics.seq[topic]})
+		}
+		delete(n.topics.subscribers, topic)
+		delete(n.topics.seq, topic)
+	}
+	n.topics.lock.Unlock()
+	var fresh bool
+	for _, args := range moving {
+		args.Auth = n.sign("subscribe", args.ID)
+		err := client.Call("Node.Subscribe", args, &fresh)
+		if err != nil {
+			return err
+		}
+		Magenta.Printf("%v Hand off subscriber %v on %v to %v\n", TimeClock(), args.ID, args.Topic, addr)
+	}
+	return nil
+}
+
+func (n *Node) subscribe(sub *Subscription) (bool, error) {
+	key := topicKey(sub.Topic)
+	addr, err := n.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	client := n.dial(addr)
+	if client == nil {
+		return false, errors.New("Subscribe: client offline")
+	}
+	defer client.Close()
+	args := SubscribeArgs {
+		Topic: sub.Topic,
+		ID: sub.ID,
+		Addr: n.IP,
+		Cred: n.credential(PermRead, key, ""),
+	}
+	var fresh bool
+	err = client.Call("Node.Subscribe", args, &fresh)
+	return fresh, err
+}
+
+// refreshSubscriptionsPeriodically re-registers this node's subscriptions
+// so that those lost with a failed rendezvous node are restored
+func (n *Node) refreshSubscriptionsPeriodically() {
+	period := time.NewTicker(3 * time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		n.topics.lock.Lock()
+		var subs []*Subscription
+		for _, sub := range n.topics.subscribed {
+			subs = append(subs, sub)
+		}
+		n.topics.lock.Unlock()
+		for _, sub := range subs {
+			fresh, err := n.subscribe(sub)
+			if err != nil {
+				Cyan.Println(TimeClock(), "refresh subscription:", err, "for", sub.ID)
+			} else if fresh {
+				Yellow.Println(TimeClock(), "refresh subscription: restored", sub.ID, "on", sub.Topic)
+			}
+		}
+	}
+}
+
+// Subscribe exported
+func (c *Chord) Subscribe(topic string) (*Subscription, error) {
+	if c.Node == nil {
+		return nil, errors.New("Subscribe: have not created or joined")
+	}
+	sub := &Subscription {
+		ID: fmt.Sprintf("%v#%v", c.Node.IP, time.Now().UnixNano()),
+		Topic: topic,
+		Messages: make(chan Message, 64),
+	}
+	c.Node.topics.lock.Lock()
+	c.Node.topics.subscribed[sub.ID] = sub
+	c.Node.topics.lock.Unlock()
+	_, err := c.Node.subscribe(sub)
+	if err != nil {
+		c.Node.topics.lock.Lock()
+		delete(c.Node.topics.subscribed, sub.ID)
+		c.Node.topics.lock.Unlock()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe exported
+func (c *Chord) Unsubscribe(id string) error {
+	if c.Node == nil {
+		return errors.New("Unsubscribe: have not created or joined")
+	}
+	c.Node.topics.lock.Lock()
+	sub, ok := c.Node.topics.subscribed[id]
+	delete(c.Node.topics.subscribed, id)
+	c.Node.topics.lock.Unlock()
+	if !ok {
+		return errors.New("Unsubscribe: subscription not found")
+	}
+	key := topicKey(sub.Topic)
+	addr, err := c.Node.lookup(key)
+	if err == nil {
+		client := c.Node.dial(addr)
+		if client != nil {
+			args := SubscribeArgs {
+				Topic: sub.Topic,
+				ID: id,
+				Cred: c.Node.credential(PermRead, key, ""),
+			}
+			var reply bool
+			client.Call("Node.Unsubscribe", args, &reply)
+			client.Close()
+		}
+	}
+	close(sub.Messages)
+	return nil
+}
+
+// Publish exported
+// sends data to every subscriber of topic through its rendezvous node
+func (c *Chord) Publish(topic, data string) (int, error) {
+	if c.Node == nil {
+		return 0, errors.New("Publish: have not created or joined")
+	}
+	key := topicKey(topic)
+	addr, err := c.Node.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	client := c.Node.dial(addr)
+	if client == nil {
+		return 0, errors.New("Publish: client offline")
+	}
+	defer client.Close()
+	var delivered int
+	args := PublishArgs {
+		Topic: topic,
+		From: c.Node.IP,
+		Data: data,
+		Cred: c.Node.credential(PermWrite, key, data),
+	}
+	err = client.Call("Node.Publish", args, &delivered)
+	return delivered, err
+}
+
+// SubscribeCmd exported
+func (c *Chord) SubscribeCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Subscribe: expect topic")
+	}
+	sub, err := c.Subscribe(args[0])
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Subscribe %v on %v\n", TimeClock(), sub.ID, sub.Topic)
+	go func() {
+		for msg := range sub.Messages {
+			Blue.Printf("%v Topic %v #%v from %v: %v\n", TimeClock(), msg.Topic, msg.Seq, msg.From, msg.Data)
+		}
+	}()
+	return nil
+}
+
+// UnsubscribeCmd exported
+func (c *Chord) UnsubscribeCmd(args ...string) error {
+	if len(args) < 1 {
+		return errors.New("Unsubscribe: expect subscription id")
+	}
+	return c.Unsubscribe(args[0])
+}
+
+// PublishCmd exported
+func (c *Chord) PublishCmd(args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Publish: expect topic and message")
+	}
+	delivered, err := c.Publish(args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	Magenta.Printf("%v Published to %v, %v subscribers\n", TimeClock(), args[0], delivered)
+	return nil
+}
@@ -0,0 +1,310 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limits on a single command, the same as Redis's, so that a client can't
+// make the node allocate without bound
+const (
+	maxRESPArgs = 1024 * 1024
+	maxRESPBulk = 512 * 1024 * 1024
+)
+
+// respServer speaks the Redis serialization protocol so that redis-cli and
+// Redis client libraries can use the ring
+type respServer struct {
+	node     *Node
+	addr     string
+	listener net.Listener
+}
+
+func newrespServer(n *Node, port string) *respServer {
+	return &respServer{
+		node: n,
+		addr: withPort(n.IP, port),
+	}
+}
+
+func (s *respServer) listen() error {
+	l, err := s.node.listen(s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go s.accept()
+	return nil
+}
+
+func (s *respServer) quit() {
+	s.listener.Close()
+}
+
+func (s *respServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeRESPError(w, err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			w.WriteString("+OK\r\n")
+			w.Flush()
+			return
+		}
+		s.exec(w, args)
+		w.Flush()
+	}
+}
+
+// readCommand reads either a RESP array of bulk strings or an inline command
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxRESPArgs {
+		return nil, errors.New("Protocol error: invalid multibulk length")
+	}
+	args := make([]string, 0, min(count, 64))
+	for i := 0; i < count; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("Protocol error: expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulk {
+			return nil, errors.New("Protocol error: invalid bulk length")
+		}
+		// the buffer grows as the bytes arrive rather than up front
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, r, int64(size) + 2)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf.Bytes()[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESPError(w *bufio.Writer, msg string) {
+	w.WriteString("-ERR " + msg + "\r\n")
+}
+
+func writeRESPInt(w *bufio.Writer, i int) {
+	w.WriteString(":" + strconv.Itoa(i) + "\r\n")
+}
+
+func writeRESPBulk(w *bufio.Writer, s string, ok bool) {
+	if !ok {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func wrongArgs(cmd string) string {
+	return fmt.Sprintf("wrong number of arguments for '%v' command", strings.ToLower(cmd))
+}
+
+// get routes to the owner of key the same way GetCmd does
+func (s *respServer) get(key string) (string, error) {
+	addr, err := s.node.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	return s.node.rpcGet(addr, key)
+}
+
+func (s *respServer) set(key, val string) error {
+	addr, err := s.node.lookup(key)
+	if err != nil {
+		return err
+	}
+	return s.node.rpcPut(addr, PutArgs{Key: key, Val: val})
+}
+
+func (s *respServer) exec(w *bufio.Writer, args []string) {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			writeRESPBulk(w, args[1], true)
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+	case "COMMAND":
+		w.WriteString("*0\r\n")
+	case "GET":
+		if len(args) != 2 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		val, err := s.get(args[1])
+		if err != nil {
+			writeRESPError(w, err.Error())
+			return
+		}
+		writeRESPBulk(w, val, val != "")
+	case "SET":
+		if len(args) != 3 && len(args) != 5 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		var ttl time.Duration
+		if len(args) == 5 {
+			secs, err := strconv.Atoi(args[4])
+			if err != nil || secs <= 0 {
+				writeRESPError(w, "invalid expire time in 'set' command")
+				return
+			}
+			switch strings.ToUpper(args[3]) {
+			case "EX":
+				ttl = time.Duration(secs) * time.Second
+			case "PX":
+				ttl = time.Duration(secs) * time.Millisecond
+			default:
+				writeRESPError(w, "syntax error")
+				return
+			}
+		}
+		err := s.set(args[1], args[2])
+		if err == nil && ttl > 0 {
+			_, err = s.node.rpcExpire(s.node.find(args[1]), ExpireArgs{Key: args[1], TTL: ttl})
+		}
+		if err != nil {
+			writeRESPError(w, err.Error())
+			return
+		}
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		if len(args) < 2 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		count := 0
+		for _, key := range args[1:] {
+			ok, err := s.node.rpcDelete(s.node.find(key), key)
+			if err != nil {
+				writeRESPError(w, err.Error())
+				return
+			}
+			if ok {
+				count++
+			}
+		}
+		writeRESPInt(w, count)
+	case "EXISTS":
+		if len(args) < 2 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		count := 0
+		for _, key := range args[1:] {
+			val, err := s.get(key)
+			if err != nil {
+				writeRESPError(w, err.Error())
+				return
+			}
+			if val != "" {
+				count++
+			}
+		}
+		writeRESPInt(w, count)
+	case "MGET":
+		if len(args) < 2 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		vals := make([]string, 0, len(args) - 1)
+		for _, key := range args[1:] {
+			val, err := s.get(key)
+			if err != nil {
+				writeRESPError(w, err.Error())
+				return
+			}
+			vals = append(vals, val)
+		}
+		w.WriteString("*" + strconv.Itoa(len(vals)) + "\r\n")
+		for _, val := range vals {
+			writeRESPBulk(w, val, val != "")
+		}
+	case "MSET":
+		if len(args) < 3 || len(args) % 2 == 0 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		for i := 1; i < len(args); i += 2 {
+			err := s.set(args[i], args[i + 1])
+			if err != nil {
+				writeRESPError(w, err.Error())
+				return
+			}
+		}
+		w.WriteString("+OK\r\n")
+	case "EXPIRE":
+		if len(args) != 3 {
+			writeRESPError(w, wrongArgs(cmd))
+			return
+		}
+		secs, err := strconv.Atoi(args[2])
+		if err != nil {
+			writeRESPError(w, "value is not an integer or out of range")
+			return
+		}
+		ok, err := s.node.rpcExpire(s.node.find(args[1]), ExpireArgs{Key: args[1], TTL: time.Duration(secs) * time.Second})
+		if err != nil {
+			writeRESPError(w, err.Error())
+			return
+		}
+		if ok {
+			writeRESPInt(w, 1)
+		} else {
+			writeRESPInt(w, 0)
+		}
+	default:
+		writeRESPError(w, fmt.Sprintf("unknown command '%v'", args[0]))
+	}
+}
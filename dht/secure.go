@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LookupError exported
+// a secure lookup whose paths disagreed, too few of whose paths answered,
+// or whose owner failed the cross-check; Answers maps each first hop to the
+// owner it reported
+type LookupError struct {
+	Key string
+	Answers map[string]string
+	Reason string
+}
+
+func (e *LookupError) Error() string {
+	hops := []string{}
+	for hop, owner := range e.Answers {
+		if owner == "" {
+			owner = "?"
+		}
+		hops = append(hops, hop + "->" + owner)
+	}
+	sort.Strings(hops)
+	return "secure lookup " + e.Key + ": " + e.Reason + " [" + strings.Join(hops, " ") + "]"
+}
+
+// firstHops picks up to count distinct live nodes to start independent
+// lookups of id from, closest preceding fingers first, then successors
+func (n *Node) firstHops(id *big.Int, count int) []string {
+	hops := []string{}
+	seen := map[string]bool{"": true, n.IP: true}
+	add := func(addr string) {
+		if len(hops) < count && !seen[addr] && n.ping(addr) {
+			hops = append(hops, addr)
+		}
+		seen[addr] = true
+	}
+	for i := 160; i > 0; i-- {
+		if !seen[n.finger[i]] && between(n.id, n.idOf(n.finger[i]), id, false) {
+			add(n.finger[i])
+		}
+	}
+	for _, suc := range n.successor {
+		add(suc)
+	}
+	return hops
+}
+
+// crossCheck asks owner's neighbours whether owner really holds id: its
+// predecessor must precede id, and its successor must name it predecessor
+func (n *Node) crossCheck(owner string, id *big.Int) error {
+	pred, err := n.rpcGetPredecessor(owner)
+	if err != nil {
+		return err
+	}
+	if pred != "" && pred != owner && !between(n.idOf(pred), id, n.idOf(owner), true) {
+		return errors.New("owner's predecessor " + pred + " follows the key")
+	}
+	client := n.dial(owner)
+	if client == nil {
+		return errors.New("owner offline")
+	}
+	var suc string
+	err = client.Call("Node.PassSuccessor", 0, &suc)
+	client.Close()
+	if err != nil {
+		return err
+	}
+	if suc == "" || suc == owner {
+		return nil
+	}
+	back, err := n.rpcGetPredecessor(suc)
+	if err != nil {
+		return err
+	}
+	if back != owner && back != "" && between(n.idOf(back), id, n.idOf(suc), true) {
+		return errors.New("owner's successor " + suc + " claims the key")
+	}
+	return nil
+}
+
+// secureLookup resolves the owner of key through n.secure independent
+// first hops and only answers when a majority of them answer, all answers
+// agree and the owner checks out
+func (n *Node) secureLookup(key string) (string, error) {
+	id := hashString(key)
+	if between(n.idOf(n.predecessor), id, n.id, true) && n.predecessor != "" {
+		return n.IP, nil
+	}
+	quorum := n.secure / 2 + 1
+	hops := n.firstHops(id, n.secure)
+	answers := make(map[string]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, hop := range hops {
+		wg.Add(1)
+		go func(hop string) {
+			defer wg.Done()
+			owner, err := n.rpcFindSuccessor(hop, id)
+			if err != nil {
+				owner = ""
+			}
+			lock.Lock()
+			answers[hop] = owner
+			lock.Unlock()
+		}(hop)
+	}
+	wg.Wait()
+	owner := ""
+	answered := 0
+	for _, hop := range hops {
+		if answers[hop] == "" {
+			continue
+		}
+		answered++
+		if owner == "" {
+			owner = answers[hop]
+		} else if answers[hop] != owner {
+			return "", &LookupError{Key: key, Answers: answers, Reason: "paths disagree"}
+		}
+	}
+	if answered < quorum {
+		return "", &LookupError{Key: key, Answers: answers, Reason: "too few paths"}
+	}
+	err := n.crossCheck(owner, id)
+	if err != nil {
+		return "", &LookupError{Key: key, Answers: answers, Reason: err.Error()}
+	}
+	return owner, nil
+}
@@ -0,0 +1,191 @@
+package dht
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Period exported
+// bounds of the period of one maintenance loop: it starts at Min, doubles
+// with every round that changes nothing up to Max, and drops back to Min
+// when a round sees a failure or a new neighbour
+type Period struct {
+	Min, Max time.Duration
+}
+
+// Timers exported
+// Jitter is the fraction by which every period is stretched or shrunk at
+// random, so that nodes started together don't probe in step
+type Timers struct {
+	Stabilize, CheckPredecessor, FixFingers Period
+	Jitter float64
+}
+
+// DefaultTimers exported
+var DefaultTimers = Timers {
+	Stabilize: Period{Min: 100 * time.Millisecond, Max: time.Second},
+	CheckPredecessor: Period{Min: 100 * time.Millisecond, Max: time.Second},
+	FixFingers: Period{Min: 100 * time.Millisecond, Max: 2 * time.Second},
+	Jitter: 0.2,
+}
+
+// maintainer paces one maintenance loop
+type maintainer struct {
+	lock sync.Mutex
+	period Period
+	jitter float64
+	current time.Duration
+	wake chan struct{}
+}
+
+func newmaintainer(period Period, jitter float64) *maintainer {
+	return &maintainer {
+		period: period,
+		jitter: jitter,
+		current: period.Min,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// next adapts the period to the last round and returns the jittered delay
+// until the next one
+func (m *maintainer) next(changed bool) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if changed {
+		m.current = m.period.Min
+	} else {
+		m.current *= 2
+		if m.current > m.period.Max {
+			m.current = m.period.Max
+		}
+	}
+	delay := m.current
+	if m.jitter > 0 {
+		delay += time.Duration((rand.Float64() * 2 - 1) * m.jitter * float64(m.current))
+	}
+	return delay
+}
+
+// poke runs the loop right away at its shortest period
+func (m *maintainer) poke() {
+	m.lock.Lock()
+	m.current = m.period.Min
+	m.lock.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *maintainer) snapshot() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.current
+}
+
+// upkeep holds the loops that keep the ring together
+type upkeep struct {
+	stabilize, checkPredecessor, fixFingers *maintainer
+}
+
+func newupkeep(t Timers) upkeep {
+	return upkeep {
+		stabilize: newmaintainer(t.Stabilize, t.Jitter),
+		checkPredecessor: newmaintainer(t.CheckPredecessor, t.Jitter),
+		fixFingers: newmaintainer(t.FixFingers, t.Jitter),
+	}
+}
+
+// neighbourChanged speeds every loop up after n saw a node join or leave
+// next to it
+func (n *Node) neighbourChanged() {
+	n.upkeep.stabilize.poke()
+	n.upkeep.checkPredecessor.poke()
+	n.upkeep.fixFingers.poke()
+}
+
+// maintain runs round paced by m until n stops; round reports whether it
+// changed anything or failed
+func (n *Node) maintain(m *maintainer, round func() bool) {
+	timer := time.NewTimer(m.next(true))
+	defer timer.Stop()
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-m.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+		timer.Reset(m.next(round()))
+	}
+}
+
+func parsePeriod(min, max string) (Period, error) {
+	lo, err := time.ParseDuration(min)
+	if err != nil {
+		return Period{}, err
+	}
+	hi, err := time.ParseDuration(max)
+	if err != nil {
+		return Period{}, err
+	}
+	if lo <= 0 || hi < lo {
+		return Period{}, errors.New("expect 0 < min <= max")
+	}
+	return Period{Min: lo, Max: hi}, nil
+}
+
+// TimersCmd exported
+// timers <stabilize | check | fingers | all> <min> <max> bounds the periods
+// of the maintenance loops; timers jitter <fraction> sets their jitter
+func (c *Chord) TimersCmd(args ...string) error {
+	if c.Node != nil {
+		return errors.New("Timers: can't change once created or joined")
+	}
+	if c.timers == nil {
+		timers := DefaultTimers
+		c.timers = &timers
+	}
+	if len(args) == 2 && args[0] == "jitter" {
+		jitter, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || jitter < 0 || jitter >= 1 {
+			return errors.New("Timers: expect a jitter fraction below 1")
+		}
+		c.timers.Jitter = jitter
+		Magenta.Printf("%v Timer jitter set to %v\n", TimeClock(), jitter)
+		return nil
+	}
+	if len(args) < 3 {
+		return errors.New("Timers: expect loop, min and max period")
+	}
+	period, err := parsePeriod(args[1], args[2])
+	if err != nil {
+		return errors.New("Timers: " + err.Error())
+	}
+	switch args[0] {
+	case "stabilize":
+		c.timers.Stabilize = period
+	case "check":
+		c.timers.CheckPredecessor = period
+	case "fingers":
+		c.timers.FixFingers = period
+	case "all":
+		c.timers.Stabilize = period
+		c.timers.CheckPredecessor = period
+		c.timers.FixFingers = period
+	default:
+		return errors.New("Timers: expect stabilize, check, fingers or all")
+	}
+	Magenta.Printf("%v Timers for %v set to %v..%v\n", TimeClock(), args[0], period.Min, period.Max)
+	return nil
+}
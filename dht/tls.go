@@ -0,0 +1,258 @@
+package dht
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsStore holds a node's certificate and CA bundle, reloading them from
+// disk when the files change so that certificates rotate without restart
+type tlsStore struct {
+	certFile, keyFile, caFile string
+	lock sync.Mutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+	modTime time.Time
+	checked time.Time
+	generation int
+}
+
+func newtlsStore(certFile, keyFile, caFile string) (*tlsStore, error) {
+	s := &tlsStore{
+		certFile: certFile,
+		keyFile: keyFile,
+		caFile: caFile,
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s, s.load()
+}
+
+func (s *tlsStore) latest() time.Time {
+	var latest time.Time
+	for _, file := range []string{s.certFile, s.keyFile, s.caFile} {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (s *tlsStore) load() error {
+	modTime := s.latest()
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(s.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.New("tls: no certificate found in " + s.caFile)
+	}
+	s.cert, s.pool, s.modTime = &cert, pool, modTime
+	s.generation++
+	return nil
+}
+
+// current returns the certificate and CA pool in use, checking the files
+// for changes at most once a second
+func (s *tlsStore) current() (*tls.Certificate, *x509.CertPool, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if time.Since(s.checked) > time.Second {
+		s.checked = time.Now()
+		if s.latest().After(s.modTime) {
+			err := s.load()
+			if err != nil {
+				Yellow.Println(TimeClock(), "tls: keep old certificate,", err)
+			} else {
+				Magenta.Println(TimeClock(), "tls: reloaded", s.certFile)
+			}
+		}
+	}
+	return s.cert, s.pool, s.generation
+}
+
+func (s *tlsStore) reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load()
+}
+
+func (s *tlsStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, _ := s.current()
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs: pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				NextProtos: []string{"h2"},
+				MinVersion: tls.VersionTLS12,
+			}, nil
+		},
+	}
+}
+
+func (s *tlsStore) clientConfig(addr string) *tls.Config {
+	cert, pool, _ := s.current()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs: pool,
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// listen opens addr for n, behind mutual TLS when n has certificates
+func (n *Node) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || n.tls == nil {
+		return l, err
+	}
+	return tls.NewListener(l, n.tls.serverConfig()), nil
+}
+
+// GenerateCerts exported
+// writes a test CA to dir unless one is there, and a certificate signed by
+// it for each name, usable by nodes both as server and as client
+func GenerateCerts(dir string, names ...string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		caCert, caKey, err = createCA(dir)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serialNumber(),
+			Subject: pkix.Name{CommonName: name},
+			NotBefore: time.Now().Add(-time.Hour),
+			NotAfter: time.Now().AddDate(1, 0, 0),
+			KeyUsage: x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		host := name
+		if h, _, err := net.SplitHostPort(name); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = []net.IP{ip}
+		} else {
+			template.DNSNames = []string{host}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		err = writePEM(dir, certName(name), der, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certName turns a node name such as 10.0.0.1:8000 into a file name
+func certName(name string) string {
+	return strings.Replace(name, ":", "_", -1)
+}
+
+// CertFiles exported
+// returns the certificate, key and CA files GenerateCerts wrote for name
+func CertFiles(dir, name string) (string, string, string) {
+	base := filepath.Join(dir, certName(name))
+	return base + ".pem", base + "-key.pem", filepath.Join(dir, "ca.pem")
+}
+
+func serialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{CommonName: "DHT-chord test CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().AddDate(5, 0, 0),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writePEM(dir, "ca", der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("tls: CA key is not ECDSA")
+	}
+	return cert, key, nil
+}
+
+func writePEM(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	err = ioutil.WriteFile(filepath.Join(dir, name + ".pem"), certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name + "-key.pem"), keyPEM, 0600)
+}
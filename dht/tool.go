@@ -6,6 +6,7 @@ import (
 	"net/rpc"
 	"math/big"
 	"crypto/sha1"
+	"crypto/tls"
 	"github.com/fatih/color"
 )
 
@@ -30,7 +31,8 @@ func hashString(elt string) *big.Int {
 	return new(big.Int).SetBytes(hasher.Sum(nil))
 }
 
-func getLocalAddress() string { 
+// GetLocalAddress exported
+func GetLocalAddress() string { 
 	var localaddress string 
 	ifaces, err := net.Interfaces() 
 	if err != nil { 
@@ -70,20 +72,55 @@ const keySize = sha1.Size * 8
 var two = big.NewInt(2)
 var hashMod = new(big.Int).Exp(big.NewInt(2), big.NewInt(keySize), nil)
 
-func jump(address string, fingerentry int) *big.Int { 
-	n := hashString(address) 
+func jump(n *big.Int, fingerentry int) *big.Int { 
 	fingerentryminus1 := big.NewInt(int64(fingerentry) - 1) 
 	jump := new(big.Int).Exp(two, fingerentryminus1, nil) 
 	sum := new(big.Int).Add(n, jump) 
 	return new(big.Int).Mod(sum, hashMod)
 }
 
-func dial(addr string) *rpc.Client {
+// withPort swaps the port of a host:port address
+func withPort(addr, port string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// rpcClient is satisfied by *rpc.Client and by the gRPC bridge client
+type rpcClient interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+const (
+	// TransportRPC exported
+	TransportRPC = "rpc"
+	// TransportGRPC exported
+	TransportGRPC = "grpc"
+)
+
+func (n *Node) dial(addr string) rpcClient {
+	if n.transport == TransportGRPC {
+		client := n.dialGRPC(addr)
+		if client == nil {
+			return nil
+		}
+		return backoffClient{client}
+	}
+	if n.tls != nil {
+		conn, err := tls.Dial("tcp", addr, n.tls.clientConfig(addr))
+		if err != nil {
+			return nil
+		}
+		return backoffClient{rpc.NewClient(conn)}
+	}
 	client, err := rpc.Dial("tcp", addr)
 	if err != nil {
 		return nil
 	}
-	return client
+	return backoffClient{client}
 }
 
 // TimeDate exported
@@ -0,0 +1,341 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// EventPut exported
+	EventPut = "put"
+	// EventDelete exported
+	EventDelete = "delete"
+	// EventMissed exported
+	EventMissed = "missed"
+)
+
+// WatchArgs exported
+type WatchArgs struct {
+	ID, Key, Addr string
+	Prefix bool
+	Seq uint64
+	// Cred signs registrations by the watcher, Auth hand-offs between owners
+	Cred Cred
+	Auth Auth
+}
+
+// WatchEvent exported
+type WatchEvent struct {
+	ID, Type, Key, Val, From string
+	Seq uint64
+	// Missed is set when events before this one may have been lost
+	Missed bool
+}
+
+// Watch exported
+type Watch struct {
+	ID, Key string
+	Prefix bool
+	Events chan WatchEvent
+	seq map[string]uint64
+	overflow bool
+}
+
+func (w *WatchArgs) match(key string) bool {
+	if w.Prefix {
+		return strings.HasPrefix(key, w.Key)
+	}
+	return key == w.Key
+}
+
+// Watch exported
+func (n *Node) Watch(args WatchArgs, fresh *bool) error {
+	if n.allowNode(args.Auth, "watch", args.ID) != nil {
+		err := n.allow(args.Cred, PermRead, args.Key, "")
+		if err != nil {
+			return err
+		}
+	}
+	n.watchLock.Lock()
+	defer n.watchLock.Unlock()
+	w, ok := n.watchers[args.ID]
+	if !ok {
+		w = &WatchArgs{}
+		*w = args
+		n.watchers[args.ID] = w
+	} else if args.Seq > w.Seq {
+		w.Seq = args.Seq
+	}
+	*fresh = !ok
+	return nil
+}
+
+// Unwatch exported
+func (n *Node) Unwatch(id string, reply *bool) error {
+	n.watchLock.Lock()
+	defer n.watchLock.Unlock()
+	_, *reply = n.watchers[id]
+	delete(n.watchers, id)
+	return nil
+}
+
+// Deliver exported
+func (n *Node) Deliver(ev WatchEvent, reply *bool) error {
+	n.watchLock.Lock()
+	defer n.watchLock.Unlock()
+	w, ok := n.watching[ev.ID]
+	if !ok {
+		return errors.New("deliver: watch not found")
+	}
+	from := ev.ID
+	if w.Prefix {
+		from = ev.ID + "@" + ev.From
+	}
+	last, seen := w.seq[from]
+	if seen && ev.Seq <= last {
+		return nil
+	}
+	if (seen && ev.Seq != last + 1) || (!seen && !w.Prefix && ev.Seq != 1) || w.overflow {
+		ev.Missed = true
+	}
+	w.seq[from] = ev.Seq
+	w.send(ev)
+	*reply = true
+	return nil
+}
+
+func (w *Watch) send(ev WatchEvent) {
+	select {
+	case w.Events <- ev:
+		w.overflow = false
+	default:
+		w.overflow = true
+	}
+}
+
+func (n *Node) publish(typ, key, val string) {
+	n.watchLock.Lock()
+	defer n.watchLock.Unlock()
+	for _, w := range n.watchers {
+		if !w.match(key) {
+			continue
+		}
+		w.Seq++
+		ev := WatchEvent {
+			ID: w.ID,
+			Type: typ,
+			Key: key,
+			Val: val,
+			From: n.IP,
+			Seq: w.Seq,
+		}
+		select {
+		case n.events <- ev:
+		default:
+			Yellow.Println(TimeClock(), "publish: event queue full, dropping", typ, key, "for", w.ID)
+		}
+	}
+}
+
+func (n *Node) deliverEvents() {
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case ev := <-n.events:
+			n.watchLock.Lock()
+			w, ok := n.watchers[ev.ID]
+			n.watchLock.Unlock()
+			if !ok {
+				continue
+			}
+			client := n.dial(w.Addr)
+			if client == nil {
+				Cyan.Println(TimeClock(), "deliver: watcher", w.Addr, "offline, dropping", ev.ID)
+				n.watchLock.Lock()
+				delete(n.watchers, ev.ID)
+				n.watchLock.Unlock()
+				continue
+			}
+			var reply bool
+			err := client.Call("Node.Deliver", ev, &reply)
+			client.Close()
+			if err != nil {
+				Cyan.Println(TimeClock(), "deliver:", err, "to", w.Addr)
+			}
+		}
+	}
+}
+
+// handOffWatches passes watches to addr, which takes over some of n's keys;
+// key watches move with their key, prefix watches are copied, and all moves
+// every watch when n is leaving
+func (n *Node) handOffWatches(addr string, all bool) error {
+	client := n.dial(addr)
+	if client == nil {
+		return errors.New("hand off watches: client offline")
+	}
+	defer client.Close()
+	n.watchLock.Lock()
+	var moving []WatchArgs
+	for id, w := range n.watchers {
+		if all || w.Prefix {
+			moving = append(moving, *w)
+		} else if !between(n.idOf(addr), hashString(w.Key), n.id, true) {
+			moving = append(moving, *w)
+			delete(n.watchers, id)
+		}
+	}
+	n.watchLock.Unlock()
+	var fresh bool
+	for _, w := range moving {
+		w.Auth = n.sign("watch", w.ID)
+		err := client.Call("Node.Watch", w, &fresh)
+		if err != nil {
+			return err
+		}
+		Magenta.Printf("%v Hand off watch %v on %v to %v\n", TimeClock(), w.ID, w.Key, addr)
+	}
+	return nil
+}
+
+// ring walks successor pointers from n and returns every node met once
+func (n *Node) ring() []string {
+	nodes := []string{n.IP}
+	cur := n.IP
+	for i := 0; i < 1024; i++ {
+		client := n.dial(cur)
+		if client == nil {
+			break
+		}
+		var suc string
+		err := client.Call("Node.PassSuccessor", 0, &suc)
+		client.Close()
+		if err != nil || suc == "" || suc == n.IP {
+			break
+		}
+		nodes = append(nodes, suc)
+		cur = suc
+	}
+	return nodes
+}
+
+func (n *Node) register(w *Watch) (bool, error) {
+	args := WatchArgs {
+		ID: w.ID,
+		Key: w.Key,
+		Addr: n.IP,
+		Prefix: w.Prefix,
+		Cred: n.credential(PermRead, w.Key, ""),
+	}
+	targets := []string{}
+	if w.Prefix {
+		targets = n.ring()
+	} else {
+		targets = append(targets, n.find(w.Key))
+	}
+	lost := false
+	for _, addr := range targets {
+		client := n.dial(addr)
+		if client == nil {
+			return lost, errors.New("Watch: client offline")
+		}
+		var fresh bool
+		err := client.Call("Node.Watch", args, &fresh)
+		client.Close()
+		if err != nil {
+			return lost, err
+		}
+		lost = lost || fresh
+	}
+	return lost, nil
+}
+
+// refreshWatchesPeriodically re-registers this node's watches so that
+// watches lost together with a failed owner are restored and reported
+func (n *Node) refreshWatchesPeriodically() {
+	period := time.NewTicker(3 * time.Second)
+	defer period.Stop()
+	for n.tick(period) {
+		n.watchLock.Lock()
+		var watches []*Watch
+		for _, w := range n.watching {
+			watches = append(watches, w)
+		}
+		n.watchLock.Unlock()
+		for _, w := range watches {
+			lost, err := n.register(w)
+			if err != nil {
+				Cyan.Println(TimeClock(), "refresh watch:", err, "for", w.ID)
+				continue
+			}
+			if lost {
+				n.watchLock.Lock()
+				if n.watching[w.ID] != w {
+					n.watchLock.Unlock()
+					continue
+				}
+				w.send(WatchEvent {
+					ID: w.ID,
+					Type: EventMissed,
+					Key: w.Key,
+					From: n.IP,
+					Missed: true,
+				})
+				n.watchLock.Unlock()
+			}
+		}
+	}
+}
+
+// Watch exported
+func (c *Chord) Watch(key string, prefix bool) (*Watch, error) {
+	if c.Node == nil {
+		return nil, errors.New("Watch: have not created or joined")
+	}
+	w := &Watch {
+		ID: fmt.Sprintf("%v#%v", c.Node.IP, time.Now().UnixNano()),
+		Key: key,
+		Prefix: prefix,
+		Events: make(chan WatchEvent, 64),
+		seq: make(map[string]uint64),
+	}
+	c.Node.watchLock.Lock()
+	c.Node.watching[w.ID] = w
+	c.Node.watchLock.Unlock()
+	_, err := c.Node.register(w)
+	if err != nil {
+		c.Node.watchLock.Lock()
+		delete(c.Node.watching, w.ID)
+		c.Node.watchLock.Unlock()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Unwatch exported
+func (c *Chord) Unwatch(id string) error {
+	if c.Node == nil {
+		return errors.New("Unwatch: have not created or joined")
+	}
+	c.Node.watchLock.Lock()
+	w, ok := c.Node.watching[id]
+	delete(c.Node.watching, id)
+	c.Node.watchLock.Unlock()
+	if !ok {
+		return errors.New("Unwatch: watch not found")
+	}
+	var reply bool
+	for _, addr := range c.Node.ring() {
+		client := c.Node.dial(addr)
+		if client == nil {
+			continue
+		}
+		client.Call("Node.Unwatch", id, &reply)
+		client.Close()
+	}
+	close(w.Events)
+	return nil
+}
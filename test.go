@@ -2,10 +2,21 @@ package main
 
 import (
 	"os"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"context"
 	"time"
 	"strconv"
 	"DHT-chord/dht"
 	"math/rand"
+	"encoding/hex"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
 )
 
 var (
@@ -255,6 +266,1086 @@ func testBackup() {
 	}
 }
 
+func testWatch() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Watch starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	w, err := c[4].Watch("0", false)
+	if err != nil {
+		dht.Red.Println(dht.TimeClock(), err)
+		return
+	}
+	for i := 0; i < 5; i++ {
+		putCmd(i)
+	}
+	for i := 5; i < 8; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].JoinCmd(c[i - 1].Node.IP)
+		time.Sleep(time.Second)
+	}
+	deleteCmd(0, 0)
+	time.Sleep(time.Second)
+	for len(w.Events) > 0 {
+		opCount[1]++
+		ev := <-w.Events
+		if ev.Key != "0" || ev.Missed {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Watch Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testTransport() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Transport starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 10; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if (i & 1) == 0 {
+			c[i].TransportCmd(dht.TransportGRPC)
+		} else {
+			c[i].TransportCmd(dht.TransportRPC)
+		}
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < 10; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		c[i].QuitCmd()
+		time.Sleep(time.Second)
+	}
+	for i := 4; i < 10; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	dht.Green.Printf("Test Transport Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testTLS() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test TLS starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		name := dht.GetLocalAddress() + ":" + strconv.Itoa(8000 + i)
+		c[i].CertCmd("./certs", name)
+		cert, key, ca := dht.CertFiles("./certs", name)
+		c[i].TLSCmd(cert, key, ca)
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < 5; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	c[0].CertCmd("./certs", c[0].Node.IP)
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	dht.Green.Printf("Test TLS Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testSecret() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Secret starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].SecretCmd("ring secret")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < 5; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	c[5].PortCmd(strconv.Itoa(8005))
+	c[5].SecretCmd("wrong secret")
+	func() {
+		defer func() {
+			opCount[1]++
+			if recover() == nil {
+				opCount[0]++
+			}
+		}()
+		c[5].JoinCmd(c[0].Node.IP)
+	}()
+	for i := 0; i < 5; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	dht.Green.Printf("Test Secret Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testIdentity() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Identity starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].IdentityCmd("12")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < 5; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	c[5].PortCmd(strconv.Itoa(8005))
+	c[5].IdentityCmd("0")
+	func() {
+		defer func() {
+			opCount[1]++
+			if recover() == nil {
+				opCount[0]++
+			}
+		}()
+		c[5].JoinCmd(c[0].Node.IP)
+	}()
+	for i := 0; i < 5; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	dht.Green.Printf("Test Identity Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testSecure() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Secure starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 8; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].SecureCmd("3")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < 8; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	dht.Green.Printf("Test Secure Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testACL() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test ACL starts")
+	opCount[0], opCount[1] = 0, 0
+	adminPub, adminKey, _ := dht.NewIdentityKey()
+	teamPub, teamKey, _ := dht.NewIdentityKey()
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].SecretCmd("ring secret")
+		c[i].ACLCmd(hex.EncodeToString(adminPub))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	c[0].PutACL(adminKey, dht.ACL {
+		Serial: 1,
+		Clients: map[string][]byte{"team": teamPub},
+		Rules: []dht.ACLRule{{Client: "team", Prefix: "", Perms: "rwd"}},
+	})
+	time.Sleep(4 * time.Second)
+	for i := 0; i < 3; i++ {
+		c[i].ClientCmd("team", hex.EncodeToString(teamKey))
+	}
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 10; k++ {
+			putCmd(i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			getCmd(i, j)
+		}
+	}
+	for i := 3; i < 5; i++ {
+		for j := 0; j < dataCount[1]; j++ {
+			opCount[1]++
+			if c[i].GetCmd(strconv.Itoa(j)) == nil {
+				opCount[0]++
+			}
+		}
+	}
+	// the ACL can't be overwritten around Put
+	c[4].MemcacheCmd("9104")
+	host, _, _ := net.SplitHostPort(c[4].Node.IP)
+	addr := net.JoinHostPort(host, "9104")
+	expectReply(addr, "set __acl__ 0 0 7\r\ngarbage\r\n", "SERVER_ERROR acl:")
+	for i := 0; i < 5; i++ {
+		client, err := rpc.Dial("tcp", c[i].Node.IP)
+		if err != nil {
+			continue
+		}
+		var ok bool
+		opCount[1]++
+		if client.Call("Node.Expire", dht.ExpireArgs{Key: "__acl__", TTL: time.Second}, &ok) == nil {
+			opCount[0]++
+		}
+		client.Close()
+	}
+	// a captured credential is good for one put of its own value
+	digest := sha256.Sum256([]byte("signed"))
+	cred := dht.Cred{Client: "team", Time: time.Now().UnixNano(), Nonce: 42}
+	cred.Sig = ed25519.Sign(teamKey, []byte("team|" + strconv.FormatInt(cred.Time, 10) + "|42|w|replayed|" + hex.EncodeToString(digest[:])))
+	for k, val := range []string{"signed", "signed", "forged"} {
+		accepted := 0
+		for i := 0; i < 5; i++ {
+			client, err := rpc.Dial("tcp", c[i].Node.IP)
+			if err != nil {
+				continue
+			}
+			var ok bool
+			if client.Call("Node.Put", dht.PutArgs{Key: "replayed", Val: val, Cred: cred}, &ok) == nil {
+				accepted++
+			}
+			client.Close()
+		}
+		opCount[1]++
+		if k == 0 && accepted != 1 || k > 0 && accepted != 0 {
+			dht.Yellow.Printf("%v Put of %q with one credential accepted %v times\n", dht.TimeClock(), val, accepted)
+			opCount[0]++
+		}
+	}
+	// only the rendezvous node delivers, and only readers unsubscribe
+	sub, err := c[0].Subscribe("acl")
+	opCount[1]++
+	if err != nil {
+		opCount[0]++
+	} else {
+		for i := 0; i < 5; i++ {
+			client, err := rpc.Dial("tcp", c[i].Node.IP)
+			if err != nil {
+				continue
+			}
+			var ok bool
+			opCount[1] += 2
+			if client.Call("Node.Unsubscribe", dht.SubscribeArgs{Topic: "acl", ID: sub.ID}, &ok) == nil {
+				opCount[0]++
+			}
+			if client.Call("Node.Receive", dht.Message{Topic: "acl", ID: sub.ID, Data: "forged"}, &ok) == nil {
+				opCount[0]++
+			}
+			client.Close()
+		}
+		delivered, err := c[1].Publish("acl", "signed")
+		opCount[1]++
+		if err != nil || delivered != 1 || len(sub.Messages) != 1 || (<-sub.Messages).Data != "signed" {
+			dht.Yellow.Printf("%v Publish on acl delivered %v: %v\n", dht.TimeClock(), delivered, err)
+			opCount[0]++
+		}
+	}
+	time.Sleep(4 * time.Second)
+	for j := 0; j < dataCount[1]; j++ {
+		getCmd(0, j)
+	}
+	dht.Green.Printf("Test ACL Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testLimit() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Limit starts")
+	opCount[0], opCount[1] = 0, 0
+	busy := 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].LimitCmd("100", "0", "0")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 1000; k++ {
+		opCount[1]++
+		err := c[k % 5].PutCmd(strconv.Itoa(k), strconv.Itoa(k))
+		if dht.IsBusy(err) {
+			busy++
+		} else if err != nil {
+			opCount[0]++
+		}
+	}
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 5; i++ {
+		c[i].DumpCmd()
+	}
+	dht.Green.Printf("Test Limit Complete: %.2f%% Correct, %v busy\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100, busy)
+}
+
+func testBlob() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Blob starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	blobs := make([][]byte, 5)
+	for i := 0; i < 5; i++ {
+		blobs[i] = make([]byte, rand.Intn(4 * dht.ChunkSize))
+		rand.Read(blobs[i])
+		opCount[1]++
+		if c[i].PutBlob("blob" + strconv.Itoa(i), bytes.NewReader(blobs[i])) != nil {
+			opCount[0]++
+		}
+	}
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			var out bytes.Buffer
+			opCount[1]++
+			if c[i].GetBlob("blob" + strconv.Itoa(j), &out) != nil || !bytes.Equal(out.Bytes(), blobs[j]) {
+				opCount[0]++
+			}
+		}
+	}
+	dht.Green.Printf("Test Blob Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testErasure() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Erasure starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 8; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 20; k++ {
+		opCount[1]++
+		if c[k % 8].ArchiveCmd(strconv.Itoa(k), strconv.Itoa(k), "3", "5") != nil {
+			opCount[0]++
+		}
+	}
+	c[2].ForceQuitCmd()
+	c[5].ForceQuitCmd()
+	time.Sleep(15 * time.Second)
+	c[3].ForceQuitCmd()
+	time.Sleep(15 * time.Second)
+	for k := 0; k < 20; k++ {
+		opCount[1]++
+		if c[k % 2].RetrieveCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Erasure Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testFS() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test FS starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	dir, _ := ioutil.TempDir("", "dht-fs")
+	defer os.RemoveAll(dir)
+	files := make([][]byte, 5)
+	for i := 0; i < 5; i++ {
+		files[i] = make([]byte, rand.Intn(2 * dht.ChunkSize))
+		rand.Read(files[i])
+		local := filepath.Join(dir, "in" + strconv.Itoa(i))
+		ioutil.WriteFile(local, files[i], 0644)
+		opCount[1]++
+		if c[i].PutFileCmd(local, "/data/" + strconv.Itoa(i % 2) + "/f" + strconv.Itoa(i)) != nil {
+			opCount[0]++
+		}
+	}
+	opCount[1]++
+	if c[0].LsCmd("/data") != nil || c[0].RmCmd("/data/0") == nil {
+		opCount[0]++
+	}
+	for i := 0; i < 5; i++ {
+		local := filepath.Join(dir, "out" + strconv.Itoa(i))
+		opCount[1]++
+		err := c[(i + 1) % 5].GetFileCmd("/data/" + strconv.Itoa(i % 2) + "/f" + strconv.Itoa(i), local)
+		out, _ := ioutil.ReadFile(local)
+		if err != nil || !bytes.Equal(out, files[i]) {
+			opCount[0]++
+		}
+	}
+	opCount[1]++
+	if c[1].RmCmd("/data/1/f1") != nil || c[2].GetFileCmd("/data/1/f1", filepath.Join(dir, "gone")) == nil {
+		opCount[0]++
+	}
+	dht.Green.Printf("Test FS Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testLock() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Lock starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 6; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	locks := make([]*dht.Lock, 10)
+	for k := 0; k < 10; k++ {
+		var err error
+		opCount[1]++
+		locks[k], err = c[k % 3].Acquire("job" + strconv.Itoa(k), 10 * time.Second)
+		if err != nil {
+			opCount[0]++
+		}
+		opCount[1]++
+		if _, err = c[3].Acquire("job" + strconv.Itoa(k), 10 * time.Second); err == nil {
+			opCount[0]++
+		}
+	}
+	c[4].ForceQuitCmd()
+	c[5].QuitCmd()
+	time.Sleep(3 * time.Second)
+	for k := 0; k < 10; k++ {
+		if locks[k] == nil {
+			continue
+		}
+		opCount[1]++
+		if c[k % 3].Renew(locks[k]) != nil {
+			opCount[0]++
+		}
+		opCount[1]++
+		if c[k % 3].Release(locks[k]) != nil {
+			opCount[0]++
+		}
+	}
+	// waiting for the new leases to run out takes longer than the old ones
+	// had left, so all of them are released first
+	for k := 0; k < 10; k++ {
+		if locks[k] == nil {
+			continue
+		}
+		opCount[1]++
+		l, err := c[3].Acquire("job" + strconv.Itoa(k), time.Second)
+		if err != nil || l.Token <= locks[k].Token {
+			opCount[0]++
+			continue
+		}
+		opCount[1]++
+		select {
+		case <-l.Lost:
+		case <-time.After(5 * time.Second):
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Lock Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testBroadcast() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Broadcast starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 20; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 100; k++ {
+		c[k % 20].PutCmd(strconv.Itoa(k), strconv.Itoa(k))
+	}
+	time.Sleep(5 * time.Second)
+	for i := 0; i < 20; i++ {
+		opCount[1]++
+		a, err := c[i].Aggregate()
+		if err != nil || a.Nodes != 20 || a.Keys != 100 || len(a.Members) != 20 || a.Members[0] != c[i].Node.IP {
+			opCount[0]++
+		}
+	}
+	opCount[1]++
+	if c[7].BroadcastCmd("hello") != nil {
+		opCount[0]++
+	}
+	dht.Green.Printf("Test Broadcast Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testPubSub() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test PubSub starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	subs := make([]*dht.Subscription, 3)
+	for i := 0; i < 3; i++ {
+		subs[i], _ = c[i].Subscribe("topic" + strconv.Itoa(i % 2))
+	}
+	for round := 0; round < 3; round++ {
+		for t := 0; t < 2; t++ {
+			opCount[1]++
+			delivered, err := c[0].Publish("topic" + strconv.Itoa(t), strconv.Itoa(round))
+			if err != nil || delivered != 2 - t {
+				opCount[0]++
+			}
+		}
+		c[5 + round].PortCmd(strconv.Itoa(8005 + round))
+		c[5 + round].JoinCmd(c[0].Node.IP)
+		time.Sleep(time.Second)
+		c[3 + round].QuitCmd()
+		time.Sleep(4 * time.Second)
+	}
+	for i := 0; i < 3; i++ {
+		opCount[1]++
+		if subs[i] == nil || len(subs[i].Messages) != 3 {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test PubSub Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testProximity() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Proximity starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 20; i++ {
+		c[i].ProximityCmd("on")
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	time.Sleep(10 * time.Second)
+	for k := 0; k < 200; k++ {
+		opCount[1]++
+		if c[k % 20].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	for k := 0; k < 200; k++ {
+		opCount[1]++
+		if c[(k + 7) % 20].GetCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Proximity Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testCache() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Cache starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 10; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 100; k++ {
+		opCount[1]++
+		if c[0].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	for round := 0; round < 3; round++ {
+		c[10 + round].PortCmd(strconv.Itoa(8010 + round))
+		c[10 + round].JoinCmd(c[round].Node.IP)
+		c[3 + round].QuitCmd()
+		time.Sleep(3 * time.Second)
+		for k := 0; k < 100; k++ {
+			opCount[1]++
+			if c[0].GetCmd(strconv.Itoa(k)) != nil {
+				opCount[0]++
+			}
+		}
+	}
+	dht.Green.Printf("Test Cache Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testOwner() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Owner starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 5; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 5; i < 15; i++ {
+			c[i].PortCmd(strconv.Itoa(8000 + i))
+			c[i].JoinCmd(c[i % 5].Node.IP)
+			time.Sleep(300 * time.Millisecond)
+		}
+		done <- true
+	}()
+	for k := 0; k < 300; k++ {
+		opCount[1]++
+		if c[k % 5].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	<-done
+	time.Sleep(8 * time.Second)
+	for k := 0; k < 300; k++ {
+		opCount[1]++
+		if c[14 - k % 10].GetCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Owner Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testMigrate() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Migrate starts")
+	opCount[0], opCount[1] = 0, 0
+	c[0].PortCmd("8000")
+	c[0].CreateCmd()
+	for k := 0; k < 2000; k++ {
+		opCount[1]++
+		if c[0].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	for i := 1; i < 6; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i % 2 == 1 {
+			c[i].LimitCmd("1", "1", "100")
+		}
+		c[i].JoinCmd(c[0].Node.IP)
+		time.Sleep(time.Second)
+	}
+	for i := 1; i < 6; i += 2 {
+		c[i].QuitCmd()
+		time.Sleep(time.Second)
+	}
+	for _, t := range c[0].Transfers() {
+		opCount[1]++
+		if !t.Done || t.Moved != t.Total {
+			opCount[0]++
+		}
+	}
+	for k := 0; k < 2000; k++ {
+		opCount[1]++
+		if c[2 * (k % 3)].GetCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Migrate Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testHot() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Hot starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 6; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].HotCmd("20")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	time.Sleep(3 * time.Second)
+	replicaCount := 0
+	for v := 0; v < 10; v++ {
+		val := strconv.Itoa(v)
+		c[v % 6].PutCmd("hot", val)
+		for k := 0; k < 300; k++ {
+			read, err := c[k % 6].Read("hot")
+			opCount[1]++
+			if err != nil || read.Val != val {
+				opCount[0]++
+			}
+			if read.Replica {
+				replicaCount++
+			}
+		}
+	}
+	dht.Blue.Println(dht.TimeClock(), replicaCount, "reads served by replicas")
+	dht.Green.Printf("Test Hot Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testBalance() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Balance starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 6; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].BalanceCmd("on")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 1000; k++ {
+		opCount[1]++
+		if c[k % 6].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	for t := 0; t < 6; t++ {
+		for i := 0; i < 6; i++ {
+			load, _ := c[i].Load()
+			dht.Blue.Printf("%v %v load %.0f\n", dht.TimeClock(), c[i].Node.IP, load.Load())
+		}
+		time.Sleep(10 * time.Second)
+	}
+	for k := 0; k < 1000; k++ {
+		opCount[1]++
+		if c[k % 6].GetCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Balance Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testTimers() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Timers starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 6; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].TimersCmd("all", "50ms", "4s")
+		c[i].TimersCmd("jitter", "0.1")
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	for k := 0; k < 300; k++ {
+		opCount[1]++
+		if c[k % 6].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	time.Sleep(20 * time.Second)
+	for i := 0; i < 6; i++ {
+		c[i].DumpCmd()
+	}
+	c[3].QuitCmd()
+	time.Sleep(2 * time.Second)
+	for k := 0; k < 300; k++ {
+		opCount[1]++
+		if c[k % 3].GetCmd(strconv.Itoa(k)) != nil {
+			opCount[0]++
+		}
+	}
+	dht.Green.Printf("Test Timers Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testLifecycle() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Lifecycle starts")
+	opCount[0], opCount[1] = 0, 0
+	opCount[1]++
+	if c[0].QuitCmd() != nil || c[0].Shutdown(context.Background()) != nil {
+		opCount[0]++
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 4; i++ {
+			c[i].PortCmd(strconv.Itoa(8000 + i))
+			var err error
+			if i == 0 {
+				err = c[i].Start(context.Background())
+			} else {
+				err = c[i].Start(context.Background(), c[0].Node.IP)
+			}
+			opCount[1]++
+			if err != nil || c[i].Start(context.Background()) != nil || c[i].State() != dht.Running {
+				opCount[0]++
+			}
+		}
+		time.Sleep(time.Second)
+		for k := 0; k < 20; k++ {
+			opCount[1]++
+			if c[k % 4].PutCmd(strconv.Itoa(k), strconv.Itoa(k)) != nil {
+				opCount[0]++
+			}
+		}
+		for i := 3; i >= 0; i-- {
+			ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+			opCount[1]++
+			if c[i].Shutdown(ctx) != nil || c[i].Shutdown(ctx) != nil || c[i].State() != dht.Stopped {
+				opCount[0]++
+			}
+			cancel()
+		}
+	}
+	dht.Green.Printf("Test Lifecycle Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+// exchange sends request to a front-end at addr and returns what it answers
+func exchange(addr, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(request))
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	return string(buf[:n])
+}
+
+func expectReply(addr, request, want string) {
+	opCount[1]++
+	got := exchange(addr, request)
+	if !strings.HasPrefix(got, want) {
+		opCount[0]++
+		dht.Yellow.Printf("%v %q answered %q, want %q\n", dht.TimeClock(), request, got, want)
+	}
+}
+
+func testRESP() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test RESP starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 3; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	c[1].RESPCmd("9001")
+	host, _, _ := net.SplitHostPort(c[1].Node.IP)
+	addr := net.JoinHostPort(host, "9001")
+	expectReply(addr, "PING\r\n", "+PONG")
+	expectReply(addr, "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n", "+OK")
+	expectReply(addr, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "$1\r\n1\r\n")
+	expectReply(addr, "*2\r\n$3\r\nDEL\r\n$1\r\na\r\n", ":1")
+	expectReply(addr, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "$-1")
+	expectReply(addr, "SET b 1 EX 1\r\n", "+OK")
+	time.Sleep(2500 * time.Millisecond)
+	expectReply(addr, "GET b\r\n", "$-1")
+	expectReply(addr, "GET\r\n", "-ERR wrong number of arguments")
+	// malformed and oversized frames are refused without taking the node down
+	expectReply(addr, "*-1\r\n", "-ERR Protocol error")
+	expectReply(addr, "*1\r\n$-3\r\n", "-ERR Protocol error")
+	expectReply(addr, "*99999999\r\n", "-ERR Protocol error")
+	expectReply(addr, "*1\r\n$99999999999\r\n", "-ERR Protocol error")
+	expectReply(addr, "*1\r\nGET\r\n", "-ERR Protocol error")
+	expectReply(addr, "PING\r\n", "+PONG")
+	dht.Green.Printf("Test RESP Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+func testMemcache() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test Memcache starts")
+	opCount[0], opCount[1] = 0, 0
+	for i := 0; i < 3; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	c[1].MemcacheCmd("9101")
+	host, _, _ := net.SplitHostPort(c[1].Node.IP)
+	addr := net.JoinHostPort(host, "9101")
+	for k := 0; k < 10; k++ {
+		key := "key" + strconv.Itoa(k)
+		expectReply(addr, "set " + key + " 5 0 1\r\n" + strconv.Itoa(k) + "\r\n", "STORED")
+		expectReply(addr, "get " + key + "\r\n", "VALUE " + key + " 5 1\r\n" + strconv.Itoa(k) + "\r\nEND")
+	}
+	expectReply(addr, "add key1 0 0 1\r\n2\r\n", "NOT_STORED")
+	expectReply(addr, "incr key1 41\r\n", "42")
+	expectReply(addr, "delete key1\r\n", "DELETED")
+	expectReply(addr, "get key1\r\n", "END")
+	expectReply(addr, "set quiet 0 0 1 noreply\r\nx\r\nget quiet\r\n", "VALUE quiet 0 1\r\nx\r\nEND")
+	expectReply(addr, "delete quiet noreply\r\nget quiet\r\n", "END")
+	// malformed and oversized requests are refused without taking the node down
+	expectReply(addr, "noreply\r\n", "ERROR")
+	expectReply(addr, "set bad 0 0 x\r\n", "CLIENT_ERROR bad command line format")
+	expectReply(addr, "set bad 0 0 -1\r\n", "CLIENT_ERROR bad data chunk")
+	expectReply(addr, "set bad 0 0 99999999999\r\n", "CLIENT_ERROR bad data chunk")
+	expectReply(addr, "set bad 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk")
+	expectReply(addr, "version\r\n", "VERSION")
+	dht.Green.Printf("Test Memcache Complete: %.2f%% Correct\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100)
+}
+
+// expectStatus sends method with body to url and checks the status code
+func expectStatus(method, url, body string, want int) {
+	opCount[1]++
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		opCount[0]++
+		dht.Yellow.Printf("%v %v %v: %v\n", dht.TimeClock(), method, url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != want {
+		opCount[0]++
+		dht.Yellow.Printf("%v %v %v answered %v, want %v\n", dht.TimeClock(), method, url, resp.StatusCode, want)
+	}
+}
+
+func testHTTP() {
+	dht.Magenta.Println(dht.TimeClock())
+	dht.Magenta.Println(dht.TimeClock(), "Test HTTP starts")
+	opCount[0], opCount[1] = 0, 0
+	adminPub, adminKey, _ := dht.NewIdentityKey()
+	gatewayPub, gatewayKey, _ := dht.NewIdentityKey()
+	for i := 0; i < 3; i++ {
+		c[i].PortCmd(strconv.Itoa(8000 + i))
+		c[i].SecretCmd("ring secret")
+		c[i].ACLCmd(hex.EncodeToString(adminPub))
+		if i == 0 {
+			c[i].CreateCmd()
+		} else {
+			c[i].JoinCmd(c[i - 1].Node.IP)
+		}
+		time.Sleep(time.Second)
+	}
+	c[0].PutACL(adminKey, dht.ACL {
+		Serial: 1,
+		Clients: map[string][]byte{"gateway": gatewayPub},
+		Rules: []dht.ACLRule{{Client: "gateway", Prefix: "pub/", Perms: "rwd"}},
+	})
+	time.Sleep(4 * time.Second)
+	c[1].ClientCmd("gateway", hex.EncodeToString(gatewayKey))
+	c[1].HTTPCmd("9201")
+	host, _, _ := net.SplitHostPort(c[1].Node.IP)
+	url := "http://" + net.JoinHostPort(host, "9201")
+	expectStatus(http.MethodGet, url + "/health", "", http.StatusOK)
+	for k := 0; k < 10; k++ {
+		key := url + "/kv/pub/" + strconv.Itoa(k)
+		expectStatus(http.MethodPut, key, strconv.Itoa(k), http.StatusOK)
+		expectStatus(http.MethodGet, key, "", http.StatusOK)
+		expectStatus(http.MethodDelete, key, "", http.StatusOK)
+		expectStatus(http.MethodGet, key, "", http.StatusNotFound)
+		expectStatus(http.MethodDelete, key, "", http.StatusNotFound)
+	}
+	expectStatus(http.MethodPut, url + "/kv/private", "1", http.StatusForbidden)
+	expectStatus(http.MethodGet, url + "/kv/private", "", http.StatusForbidden)
+	// malformed requests are refused without reaching the ring
+	expectStatus(http.MethodGet, url + "/kv/", "", http.StatusBadRequest)
+	expectStatus(http.MethodPut, url + "/kv/pub/empty", "", http.StatusBadRequest)
+	expectStatus(http.MethodPost, url + "/kv/pub/0", "1", http.StatusMethodNotAllowed)
+	expectStatus(http.MethodPut, url + "/kv/pub/large", strings.Repeat("x", 1024 * 1024 + 1), http.StatusRequestEntityTooLarge)
+	opCount[1]++
+	req, _ := http.NewRequest(http.MethodPut, url + "/kv/pub/json", strings.NewReader("{\"value\":"))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		opCount[0]++
+	} else {
+		resp.Body.Close()
+	}
+	// owners that turn the gateway away answer 503
+	for i := 0; i < 3; i++ {
+		c[i].LimitCmd("1", "0", "0")
+	}
+	busy := 0
+	for k := 0; k < 20; k++ {
+		resp, err := http.Get(url + "/kv/pub/" + strconv.Itoa(k))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			busy++
+		}
+	}
+	opCount[1]++
+	if busy == 0 {
+		opCount[0]++
+	}
+	dht.Green.Printf("Test HTTP Complete: %.2f%% Correct, %v busy\n", float64(opCount[1] - opCount[0]) / float64(opCount[1]) * 100, busy)
+}
+
 func main() {
 	dht.Blue.Println(dht.TimeDate(), "Welcome to the dht machine testing")
 	dht.Blue.Println(dht.TimeDate(), "by Rivers Deng, Summer 2018")
@@ -267,6 +1358,31 @@ func main() {
 	*/
 	testMachine()
 	//testBackup()
+	//testWatch()
+	//testTransport()
+	//testTLS()
+	//testSecret()
+	//testIdentity()
+	//testSecure()
+	//testACL()
+	//testLimit()
+	//testBlob()
+	//testErasure()
+	//testFS()
+	//testLock()
+	//testBroadcast()
+	//testPubSub()
+	//testProximity()
+	//testCache()
+	//testOwner()
+	//testMigrate()
+	//testHot()
+	//testBalance()
+	//testTimers()
+	//testLifecycle()
+	//testRESP()
+	//testMemcache()
+	//testHTTP()
 
 	os.Exit(0)
 }